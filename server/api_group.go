@@ -15,16 +15,23 @@
 package server
 
 import (
+	"encoding/json"
+	"strconv"
+	"time"
+
 	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/heroiclabs/nakama/api"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
+	"go.uber.org/zap"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
-	"time"
 )
 
 func (s *ApiServer) CreateGroup(ctx context.Context, in *api.CreateGroupRequest) (*api.Group, error) {
@@ -38,7 +45,7 @@ func (s *ApiServer) CreateGroup(ctx context.Context, in *api.CreateGroupRequest)
 	if fn := s.runtime.beforeReqFunctions.beforeCreateGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.CreateGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -66,11 +73,13 @@ func (s *ApiServer) CreateGroup(ctx context.Context, in *api.CreateGroupRequest)
 		return nil, status.Error(codes.Internal, "Error while trying to create group.")
 	}
 
+	s.publishGroupEvent(ctx, uuid.FromStringOrNil(group.GetId()), userID, GroupEventActionCreate, nil, group)
+
 	// After hook.
 	if fn := s.runtime.afterReqFunctions.afterCreateGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.CreateGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -83,6 +92,9 @@ func (s *ApiServer) CreateGroup(ctx context.Context, in *api.CreateGroupRequest)
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("CreateGroup", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, group)
+
 	return group, nil
 }
 
@@ -114,7 +126,7 @@ func (s *ApiServer) UpdateGroup(ctx context.Context, in *api.UpdateGroupRequest)
 	if fn := s.runtime.beforeReqFunctions.beforeUpdateGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.UpdateGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -134,6 +146,23 @@ func (s *ApiServer) UpdateGroup(ctx context.Context, in *api.UpdateGroupRequest)
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	if decision, err := s.evaluateGroupAcl(ctx, groupID, GroupAclActionUpdate); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to evaluate group acl.")
+	} else if decision.Effect == GroupAclEffectDeny {
+		return nil, status.Error(codes.PermissionDenied, "Denied by group acl.")
+	} else if decision.Effect != GroupAclEffectAllow {
+		// No rule matched, or one matched with an effect other than Allow: fall
+		// back to the existing role-based default rather than letting an
+		// Allow-less decision rely solely on whatever check the delegate below
+		// happens to enforce.
+		if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+			if err == ErrGroupPermissionDenied {
+				return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to update it.")
+			}
+			return nil, status.Error(codes.Internal, "Error while trying to update group.")
+		}
+	}
+
 	err = UpdateGroup(s.logger, s.db, groupID, userID, nil, in.GetName(), in.GetLangTag(), in.GetDescription(), in.GetAvatarUrl(), nil, in.GetOpen(), -1)
 	if err != nil {
 		if err == ErrGroupPermissionDenied {
@@ -146,11 +175,13 @@ func (s *ApiServer) UpdateGroup(ctx context.Context, in *api.UpdateGroupRequest)
 		return nil, status.Error(codes.Internal, "Error while trying to update group.")
 	}
 
+	s.publishGroupEvent(ctx, groupID, userID, GroupEventActionUpdate, nil, in)
+
 	// After hook.
 	if fn := s.runtime.afterReqFunctions.afterUpdateGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.UpdateGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -163,6 +194,9 @@ func (s *ApiServer) UpdateGroup(ctx context.Context, in *api.UpdateGroupRequest)
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("UpdateGroup", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
 	return &empty.Empty{}, nil
 }
 
@@ -182,7 +216,7 @@ func (s *ApiServer) DeleteGroup(ctx context.Context, in *api.DeleteGroupRequest)
 	if fn := s.runtime.beforeReqFunctions.beforeDeleteGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.DeleteGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -210,11 +244,13 @@ func (s *ApiServer) DeleteGroup(ctx context.Context, in *api.DeleteGroupRequest)
 		return nil, status.Error(codes.Internal, "Error while trying to delete group.")
 	}
 
+	s.publishGroupEvent(ctx, groupID, userID, GroupEventActionDelete, nil, nil)
+
 	// After hook.
 	if fn := s.runtime.afterReqFunctions.afterDeleteGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.DeleteGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -227,6 +263,9 @@ func (s *ApiServer) DeleteGroup(ctx context.Context, in *api.DeleteGroupRequest)
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("DeleteGroup", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
 	return &empty.Empty{}, nil
 }
 
@@ -246,7 +285,7 @@ func (s *ApiServer) JoinGroup(ctx context.Context, in *api.JoinGroupRequest) (*e
 	if fn := s.runtime.beforeReqFunctions.beforeJoinGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.JoinGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -266,6 +305,36 @@ func (s *ApiServer) JoinGroup(ctx context.Context, in *api.JoinGroupRequest) (*e
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	decision, err := s.evaluateGroupAcl(ctx, groupID, GroupAclActionJoin)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to evaluate group acl.")
+	}
+	if decision.Effect == GroupAclEffectDeny {
+		return nil, status.Error(codes.PermissionDenied, "Denied by group acl.")
+	}
+
+	open, err := groupIsOpen(s.db, groupID)
+	if err != nil {
+		if err == ErrGroupNotFound {
+			return nil, status.Error(codes.NotFound, "Group not found.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to join group.")
+	}
+
+	// A RequireApproval rule queues the same pending GroupJoinRequest a closed
+	// group would, even if the group itself is open, so a matched rule can
+	// add a manual approval step without making the whole group closed.
+	// Conversely an Allow rule joins immediately even if the group is closed,
+	// so a matched rule can grant access without making the whole group open.
+	if (!open || decision.Effect == GroupAclEffectRequireApproval) && decision.Effect != GroupAclEffectAllow {
+		expiresAt := time.Now().UTC().Add(groupJoinRequestTTL)
+		if err := CreateGroupJoinRequest(s.logger, s.db, groupID, userID, in.GetMessage(), 2, expiresAt); err != nil {
+			return nil, status.Error(codes.Internal, "Error while trying to join group.")
+		}
+		s.notifyGroupJoinRequestCreated(ctx, groupID, userID)
+		return &empty.Empty{}, nil
+	}
+
 	err = JoinGroup(s.logger, s.db, groupID, userID)
 	if err != nil {
 		if err == ErrGroupNotFound {
@@ -276,11 +345,13 @@ func (s *ApiServer) JoinGroup(ctx context.Context, in *api.JoinGroupRequest) (*e
 		return nil, status.Error(codes.Internal, "Error while trying to join group.")
 	}
 
+	s.publishGroupEvent(ctx, groupID, userID, GroupEventActionJoin, nil, nil)
+
 	// After hook.
 	if fn := s.runtime.afterReqFunctions.afterJoinGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.JoinGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -293,6 +364,9 @@ func (s *ApiServer) JoinGroup(ctx context.Context, in *api.JoinGroupRequest) (*e
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("JoinGroup", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
 	return &empty.Empty{}, nil
 }
 
@@ -312,7 +386,7 @@ func (s *ApiServer) LeaveGroup(ctx context.Context, in *api.LeaveGroupRequest) (
 	if fn := s.runtime.beforeReqFunctions.beforeLeaveGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.LeaveGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -340,11 +414,13 @@ func (s *ApiServer) LeaveGroup(ctx context.Context, in *api.LeaveGroupRequest) (
 		return nil, status.Error(codes.Internal, "Error while trying to leave group.")
 	}
 
+	s.publishGroupEvent(ctx, groupID, userID, GroupEventActionLeave, nil, nil)
+
 	// After hook.
 	if fn := s.runtime.afterReqFunctions.afterLeaveGroupFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.LeaveGroup"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -357,6 +433,9 @@ func (s *ApiServer) LeaveGroup(ctx context.Context, in *api.LeaveGroupRequest) (
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("LeaveGroup", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
 	return &empty.Empty{}, nil
 }
 
@@ -389,7 +468,7 @@ func (s *ApiServer) AddGroupUsers(ctx context.Context, in *api.AddGroupUsersRequ
 	if fn := s.runtime.beforeReqFunctions.beforeAddGroupUsersFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.AddGroupUsers"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -409,7 +488,22 @@ func (s *ApiServer) AddGroupUsers(ctx context.Context, in *api.AddGroupUsersRequ
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
-	err = AddGroupUsers(s.logger, s.db, userID, groupID, userIDs)
+	if decision, err := s.evaluateGroupAcl(ctx, groupID, GroupAclActionAdd); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to evaluate group acl.")
+	} else if decision.Effect == GroupAclEffectDeny {
+		return nil, status.Error(codes.PermissionDenied, "Denied by group acl.")
+	} else if decision.Effect != GroupAclEffectAllow {
+		if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+			if err == ErrGroupPermissionDenied {
+				return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to add users.")
+			}
+			return nil, status.Error(codes.Internal, "Error while trying to add users to a group.")
+		}
+	}
+
+	expiresAt := groupUserExpiriesFromRequest(in.GetExpiresAt())
+
+	err = AddGroupUsers(s.logger, s.db, userID, groupID, userIDs, expiresAt)
 	if err != nil {
 		if err == ErrGroupPermissionDenied {
 			return nil, status.Error(codes.NotFound, "Group not found or permission denied.")
@@ -419,11 +513,19 @@ func (s *ApiServer) AddGroupUsers(ctx context.Context, in *api.AddGroupUsersRequ
 		return nil, status.Error(codes.Internal, "Error while trying to add users to a group.")
 	}
 
+	if s.groupReaper != nil {
+		for uid, expiresAt := range expiresAt {
+			s.groupReaper.ScheduleExpiry(groupID, uid, expiresAt)
+		}
+	}
+
+	s.publishGroupEvent(ctx, groupID, userID, GroupEventActionAdd, nil, in)
+
 	// After hook.
 	if fn := s.runtime.afterReqFunctions.afterAddGroupUsersFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.AddGroupUsers"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -436,6 +538,9 @@ func (s *ApiServer) AddGroupUsers(ctx context.Context, in *api.AddGroupUsersRequ
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("AddGroupUsers", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
 	return &empty.Empty{}, nil
 }
 
@@ -468,7 +573,7 @@ func (s *ApiServer) KickGroupUsers(ctx context.Context, in *api.KickGroupUsersRe
 	if fn := s.runtime.beforeReqFunctions.beforeKickGroupUsersFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.KickGroupUsers"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -488,6 +593,19 @@ func (s *ApiServer) KickGroupUsers(ctx context.Context, in *api.KickGroupUsersRe
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	if decision, err := s.evaluateGroupAcl(ctx, groupID, GroupAclActionKick); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to evaluate group acl.")
+	} else if decision.Effect == GroupAclEffectDeny {
+		return nil, status.Error(codes.PermissionDenied, "Denied by group acl.")
+	} else if decision.Effect != GroupAclEffectAllow {
+		if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+			if err == ErrGroupPermissionDenied {
+				return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to kick users.")
+			}
+			return nil, status.Error(codes.Internal, "Error while trying to kick users from a group.")
+		}
+	}
+
 	if err = KickGroupUsers(s.logger, s.db, userID, groupID, userIDs); err != nil {
 		if err == ErrGroupPermissionDenied {
 			return nil, status.Error(codes.NotFound, "Group not found or permission denied.")
@@ -495,11 +613,13 @@ func (s *ApiServer) KickGroupUsers(ctx context.Context, in *api.KickGroupUsersRe
 		return nil, status.Error(codes.Internal, "Error while trying to kick users from a group.")
 	}
 
+	s.publishGroupEvent(ctx, groupID, userID, GroupEventActionKick, nil, in)
+
 	// After hook.
 	if fn := s.runtime.afterReqFunctions.afterKickGroupUsersFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.KickGroupUsers"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -512,6 +632,9 @@ func (s *ApiServer) KickGroupUsers(ctx context.Context, in *api.KickGroupUsersRe
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("KickGroupUsers", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
 	return &empty.Empty{}, nil
 }
 
@@ -544,7 +667,7 @@ func (s *ApiServer) PromoteGroupUsers(ctx context.Context, in *api.PromoteGroupU
 	if fn := s.runtime.beforeReqFunctions.beforePromoteGroupUsersFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.PromoteGroupUsers"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -564,7 +687,22 @@ func (s *ApiServer) PromoteGroupUsers(ctx context.Context, in *api.PromoteGroupU
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
-	err = PromoteGroupUsers(s.logger, s.db, userID, groupID, userIDs)
+	if decision, err := s.evaluateGroupAcl(ctx, groupID, GroupAclActionPromote); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to evaluate group acl.")
+	} else if decision.Effect == GroupAclEffectDeny {
+		return nil, status.Error(codes.PermissionDenied, "Denied by group acl.")
+	} else if decision.Effect != GroupAclEffectAllow {
+		if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+			if err == ErrGroupPermissionDenied {
+				return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to promote users.")
+			}
+			return nil, status.Error(codes.Internal, "Error while trying to promote users in a group.")
+		}
+	}
+
+	expiresAt := groupUserExpiriesFromRequest(in.GetExpiresAt())
+
+	err = PromoteGroupUsers(s.logger, s.db, userID, groupID, userIDs, expiresAt)
 	if err != nil {
 		if err == ErrGroupPermissionDenied {
 			return nil, status.Error(codes.NotFound, "Group not found or permission denied.")
@@ -572,11 +710,19 @@ func (s *ApiServer) PromoteGroupUsers(ctx context.Context, in *api.PromoteGroupU
 		return nil, status.Error(codes.Internal, "Error while trying to promote users in a group.")
 	}
 
+	if s.groupReaper != nil {
+		for uid, expiresAt := range expiresAt {
+			s.groupReaper.ScheduleExpiry(groupID, uid, expiresAt)
+		}
+	}
+
+	s.publishGroupEvent(ctx, groupID, userID, GroupEventActionPromote, nil, in)
+
 	// After hook.
 	if fn := s.runtime.afterReqFunctions.afterPromoteGroupUsersFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.PromoteGroupUsers"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -589,6 +735,9 @@ func (s *ApiServer) PromoteGroupUsers(ctx context.Context, in *api.PromoteGroupU
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("PromoteGroupUsers", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
 	return &empty.Empty{}, nil
 }
 
@@ -602,11 +751,15 @@ func (s *ApiServer) ListGroupUsers(ctx context.Context, in *api.ListGroupUsersRe
 		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
 	}
 
+	if err := s.checkRateLimit(ctx, "ListGroupUsers"); err != nil {
+		return nil, err
+	}
+
 	// Before hook.
 	if fn := s.runtime.beforeReqFunctions.beforeListGroupUsersFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.ListGroupUsers"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -624,6 +777,21 @@ func (s *ApiServer) ListGroupUsers(ctx context.Context, in *api.ListGroupUsersRe
 		// Stats measurement end boundary.
 		span.End()
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	} else if s.wasmRuntime != nil {
+		// Wasm before hook, used when no Lua/Go before hook is registered for
+		// this RPC.
+		result := &api.ListGroupUsersRequest{}
+		if err := s.wasmRuntime.InvokeBeforeHookProto("nakama.api-before.Nakama.ListGroupUsers", wasmModuleGroupHooks, "before_list_group_users", in, result); err == nil {
+			in = result
+		} else if err != ErrWasmModuleNotFound {
+			s.logger.Warn("Error invoking wasm before hook", zap.Error(err), zap.String("rpc", "ListGroupUsers"))
+		}
+	}
+
+	if decision, err := s.evaluateGroupAcl(ctx, groupID, GroupAclActionListUsers); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to evaluate group acl.")
+	} else if decision.Effect == GroupAclEffectDeny {
+		return nil, status.Error(codes.PermissionDenied, "Denied by group acl.")
 	}
 
 	groupUsers, err := ListGroupUsers(s.logger, s.db, s.tracker, groupID)
@@ -635,7 +803,7 @@ func (s *ApiServer) ListGroupUsers(ctx context.Context, in *api.ListGroupUsersRe
 	if fn := s.runtime.afterReqFunctions.afterListGroupUsersFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.ListGroupUsers"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -646,8 +814,13 @@ func (s *ApiServer) ListGroupUsers(ctx context.Context, in *api.ListGroupUsersRe
 		// Stats measurement end boundary.
 		span.End()
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	} else if s.wasmRuntime != nil {
+		s.wasmRuntime.InvokeAfterHookProto("nakama.api-after.Nakama.ListGroupUsers", wasmModuleGroupHooks, "after_list_group_users", groupUsers)
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("ListGroupUsers", ctx.Value(ctxUserIDKey{}).(uuid.UUID).String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, groupUsers)
+
 	return groupUsers, nil
 }
 
@@ -661,11 +834,15 @@ func (s *ApiServer) ListUserGroups(ctx context.Context, in *api.ListUserGroupsRe
 		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
 	}
 
+	if err := s.checkRateLimit(ctx, "ListUserGroups"); err != nil {
+		return nil, err
+	}
+
 	// Before hook.
 	if fn := s.runtime.beforeReqFunctions.beforeListUserGroupsFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.ListUserGroups"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -683,6 +860,13 @@ func (s *ApiServer) ListUserGroups(ctx context.Context, in *api.ListUserGroupsRe
 		// Stats measurement end boundary.
 		span.End()
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	} else if s.wasmRuntime != nil {
+		result := &api.ListUserGroupsRequest{}
+		if err := s.wasmRuntime.InvokeBeforeHookProto("nakama.api-before.Nakama.ListUserGroups", wasmModuleGroupHooks, "before_list_user_groups", in, result); err == nil {
+			in = result
+		} else if err != ErrWasmModuleNotFound {
+			s.logger.Warn("Error invoking wasm before hook", zap.Error(err), zap.String("rpc", "ListUserGroups"))
+		}
 	}
 
 	userGroups, err := ListUserGroups(s.logger, s.db, userID)
@@ -694,7 +878,7 @@ func (s *ApiServer) ListUserGroups(ctx context.Context, in *api.ListUserGroupsRe
 	if fn := s.runtime.afterReqFunctions.afterListUserGroupsFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.ListUserGroups"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -705,8 +889,13 @@ func (s *ApiServer) ListUserGroups(ctx context.Context, in *api.ListUserGroupsRe
 		// Stats measurement end boundary.
 		span.End()
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	} else if s.wasmRuntime != nil {
+		s.wasmRuntime.InvokeAfterHookProto("nakama.api-after.Nakama.ListUserGroups", wasmModuleGroupHooks, "after_list_user_groups", userGroups)
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("ListUserGroups", ctx.Value(ctxUserIDKey{}).(uuid.UUID).String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, userGroups)
+
 	return userGroups, nil
 }
 
@@ -719,11 +908,15 @@ func (s *ApiServer) ListGroups(ctx context.Context, in *api.ListGroupsRequest) (
 		limit = int(in.GetLimit().Value)
 	}
 
+	if err := s.checkRateLimit(ctx, "ListGroups"); err != nil {
+		return nil, err
+	}
+
 	// Before hook.
 	if fn := s.runtime.beforeReqFunctions.beforeListGroupsFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-before.Nakama.ListGroups"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -741,6 +934,13 @@ func (s *ApiServer) ListGroups(ctx context.Context, in *api.ListGroupsRequest) (
 		// Stats measurement end boundary.
 		span.End()
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	} else if s.wasmRuntime != nil {
+		result := &api.ListGroupsRequest{}
+		if err := s.wasmRuntime.InvokeBeforeHookProto("nakama.api-before.Nakama.ListGroups", wasmModuleGroupHooks, "before_list_groups", in, result); err == nil {
+			in = result
+		} else if err != ErrWasmModuleNotFound {
+			s.logger.Warn("Error invoking wasm before hook", zap.Error(err), zap.String("rpc", "ListGroups"))
+		}
 	}
 
 	groups, err := ListGroups(s.logger, s.db, in.GetName(), limit, in.GetCursor())
@@ -752,7 +952,7 @@ func (s *ApiServer) ListGroups(ctx context.Context, in *api.ListGroupsRequest) (
 	if fn := s.runtime.afterReqFunctions.afterListGroupsFunction; fn != nil {
 		// Stats measurement start boundary.
 		name := "nakama.api-after.Nakama.ListGroups"
-		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name))
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
 		startNanos := time.Now().UTC().UnixNano()
 		span := trace.NewSpan(name, nil, trace.StartOptions{})
 
@@ -763,7 +963,864 @@ func (s *ApiServer) ListGroups(ctx context.Context, in *api.ListGroupsRequest) (
 		// Stats measurement end boundary.
 		span.End()
 		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	} else if s.wasmRuntime != nil {
+		s.wasmRuntime.InvokeAfterHookProto("nakama.api-after.Nakama.ListGroups", wasmModuleGroupHooks, "after_list_groups", groups)
 	}
 
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("ListGroups", ctx.Value(ctxUserIDKey{}).(uuid.UUID).String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, groups)
+
 	return groups, nil
 }
+
+// checkRateLimit enforces s.rateLimiter ahead of the before-hook so a
+// throttled caller never reaches Lua/Go hook execution or the DB. It is a
+// no-op when no rate limiter is configured or rpcName has no configured
+// rule, matching RateLimiter.Allow's own nil-safety.
+func (s *ApiServer) checkRateLimit(ctx context.Context, rpcName string) error {
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+	clientIP, _ := extractClientAddress(s.logger, ctx)
+
+	allowed, retryAfter := s.rateLimiter.Allow(rpcName, userID.String(), clientIP)
+	if allowed {
+		return nil
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1))))
+	return status.Error(codes.ResourceExhausted, "Rate limit exceeded, try again later.")
+}
+
+// evaluateGroupAcl loads the extended ACL for groupID, if any, and evaluates
+// it against the calling request's attributes. Callers should treat a Deny
+// effect as terminal. A no-match decision falls through to the existing
+// role-based default - each call site's own requireGroupAdmin check (or, for
+// JoinGroup, the open/closed check) - and so does a RequireApproval effect
+// everywhere except JoinGroup, which queues a join request for it. An Allow
+// effect grants the action outright, skipping that default.
+func (s *ApiServer) evaluateGroupAcl(ctx context.Context, groupID uuid.UUID, action GroupAclAction) (GroupAclDecision, error) {
+	acl, err := GetGroupAcl(s.logger, s.db, groupID)
+	if err != nil {
+		if err == ErrGroupNotFound {
+			return GroupAclDecision{MatchedRuleIndex: -1}, nil
+		}
+		return GroupAclDecision{}, err
+	}
+	if acl == nil {
+		return GroupAclDecision{MatchedRuleIndex: -1}, nil
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+	role, membershipAgeSec, metadata, langTag, err := groupAclRequesterAttributes(s.db, groupID, userID)
+	if err != nil {
+		return GroupAclDecision{}, err
+	}
+
+	clientIP, _ := extractClientAddress(s.logger, ctx)
+	aclCtx := GroupAclContext{
+		RequesterRole:    role,
+		UserMetadata:     metadata,
+		LangTag:          langTag,
+		ClientIp:         clientIP,
+		MembershipAgeSec: membershipAgeSec,
+	}
+	decision := EvaluateGroupAcl(acl, action, aclCtx)
+
+	if decision.MatchedRuleIndex >= 0 {
+		// Audit which rule fired and what it decided, so operators can answer
+		// "why was this request denied/allowed/queued" without reading logs.
+		s.publishGroupEvent(ctx, groupID, userID, GroupEventActionAclEvaluate, nil, map[string]interface{}{
+			"action":             string(action),
+			"effect":             string(decision.Effect),
+			"matched_rule_index": decision.MatchedRuleIndex,
+		})
+	}
+
+	return decision, nil
+}
+
+func (s *ApiServer) GetGroupAcl(ctx context.Context, in *api.GetGroupAclRequest) (*api.GroupAclList, error) {
+	if in.GetGroupId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	// Before hook.
+	if fn := s.runtime.beforeReqFunctions.beforeGetGroupAclFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-before.Nakama.GetGroupAcl"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		result, err, code := fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, in)
+		if err != nil {
+			return nil, status.Error(code, err.Error())
+		}
+		if result == nil {
+			return nil, status.Error(codes.Internal, "Runtime Before hook returned no result.")
+		}
+		in = result
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to read its acl.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to get group acl.")
+	}
+
+	acl, err := GetGroupAcl(s.logger, s.db, groupID)
+	if err != nil {
+		if err == ErrGroupNotFound {
+			return nil, status.Error(codes.NotFound, "Group not found.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to get group acl.")
+	}
+
+	list := &api.GroupAclList{GroupId: groupID.String()}
+	if acl != nil {
+		list.Rules = aclRulesToApi(acl.Rules)
+	}
+
+	// After hook.
+	if fn := s.runtime.afterReqFunctions.afterGetGroupAclFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-after.Nakama.GetGroupAcl"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, list)
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("GetGroupAcl", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, list)
+
+	return list, nil
+}
+
+func (s *ApiServer) SetGroupAcl(ctx context.Context, in *api.SetGroupAclRequest) (*empty.Empty, error) {
+	if in.GetGroupId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	// Before hook.
+	if fn := s.runtime.beforeReqFunctions.beforeSetGroupAclFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-before.Nakama.SetGroupAcl"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		result, err, code := fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, in)
+		if err != nil {
+			return nil, status.Error(code, err.Error())
+		}
+		if result == nil {
+			return nil, status.Error(codes.Internal, "Runtime Before hook returned no result.")
+		}
+		in = result
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to set its acl.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to set group acl.")
+	}
+
+	rules := make([]GroupAclRule, 0, len(in.GetRules()))
+	for _, r := range in.GetRules() {
+		rules = append(rules, GroupAclRule{
+			Action:    GroupAclAction(r.GetAction()),
+			Condition: groupAclConditionFromApi(r.GetCondition()),
+			Effect:    GroupAclEffect(r.GetEffect()),
+		})
+	}
+
+	if err := SetGroupAcl(s.logger, s.db, userID, groupID, rules); err != nil {
+		if err == ErrGroupNotFound {
+			return nil, status.Error(codes.NotFound, "Group not found.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to set group acl.")
+	}
+
+	// After hook.
+	if fn := s.runtime.afterReqFunctions.afterSetGroupAclFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-after.Nakama.SetGroupAcl"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, &empty.Empty{})
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("SetGroupAcl", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
+	return &empty.Empty{}, nil
+}
+
+// publishGroupEvent builds and publishes a GroupEvent. Mutation handlers call
+// it after the core function has committed but before the after hook runs,
+// so their events reflect only confirmed state changes; evaluateGroupAcl
+// also calls it, before any mutation, to record which ACL rule matched.
+// Marshalling failures are logged and otherwise ignored - a bad diff payload
+// must never fail the request.
+func (s *ApiServer) publishGroupEvent(ctx context.Context, groupID, actorID uuid.UUID, action GroupEventAction, before, after interface{}) {
+	if s.groupEvents == nil {
+		return
+	}
+
+	beforeJSON, err := marshalGroupEventPayload(before)
+	if err != nil {
+		s.logger.Warn("Error marshalling group event before payload", zap.Error(err))
+	}
+	afterJSON, err := marshalGroupEventPayload(after)
+	if err != nil {
+		s.logger.Warn("Error marshalling group event after payload", zap.Error(err))
+	}
+
+	clientIP, _ := extractClientAddress(s.logger, ctx)
+	s.groupEvents.Publish(&GroupEvent{
+		Id:        uuid.Must(uuid.NewV4()),
+		GroupId:   groupID,
+		ActorId:   actorID,
+		Action:    action,
+		Before:    beforeJSON,
+		After:     afterJSON,
+		ClientIp:  clientIP,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+func marshalGroupEventPayload(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+func (s *ApiServer) ListGroupEvents(ctx context.Context, in *api.ListGroupEventsRequest) (*api.GroupEventList, error) {
+	if in.GetGroupId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to list its events.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to list group events.")
+	}
+
+	limit := 100
+	if in.GetLimit() != nil {
+		limit = int(in.GetLimit().Value)
+	}
+
+	var actorID *uuid.UUID
+	if in.GetActorId() != "" {
+		a, err := uuid.FromString(in.GetActorId())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Actor ID must be a valid ID.")
+		}
+		actorID = &a
+	}
+
+	var action *GroupEventAction
+	if in.GetAction() != "" {
+		a := GroupEventAction(in.GetAction())
+		action = &a
+	}
+
+	events, cursor, err := ListGroupEvents(s.logger, s.db, groupID, actorID, action, limit, in.GetCursor())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to list group events.")
+	}
+
+	return &api.GroupEventList{
+		Events: groupEventsToApi(events),
+		Cursor: cursor,
+	}, nil
+}
+
+func (s *ApiServer) StreamGroupEvents(in *api.StreamGroupEventsRequest, stream api.Nakama_StreamGroupEventsServer) error {
+	if in.GetGroupId() == "" {
+		return status.Error(codes.InvalidArgument, "Group ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+
+	if s.groupEvents == nil {
+		return status.Error(codes.Unavailable, "Group event streaming is not enabled.")
+	}
+
+	ctx := stream.Context()
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return status.Error(codes.PermissionDenied, "You must be an admin of the group to stream its events.")
+		}
+		return status.Error(codes.Internal, "Error while trying to stream group events.")
+	}
+
+	// Subscribe before replaying the gap so events published while the
+	// backlog query runs are buffered, not lost between the two steps.
+	events, cancel := s.groupEvents.Subscribe(groupID)
+	defer cancel()
+
+	if in.GetFromCursor() != "" {
+		backlog, err := ListGroupEventsSince(s.logger, s.db, groupID, in.GetFromCursor())
+		if err != nil {
+			return status.Error(codes.Internal, "Error while trying to resume group event stream.")
+		}
+		for _, event := range backlog {
+			if err := stream.Send(groupEventToApi(event)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(groupEventToApi(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func groupEventsToApi(events []*GroupEvent) []*api.GroupEvent {
+	out := make([]*api.GroupEvent, 0, len(events))
+	for _, e := range events {
+		out = append(out, groupEventToApi(e))
+	}
+	return out
+}
+
+func groupEventToApi(e *GroupEvent) *api.GroupEvent {
+	return &api.GroupEvent{
+		Id:       e.Id.String(),
+		GroupId:  e.GroupId.String(),
+		ActorId:  e.ActorId.String(),
+		Action:   string(e.Action),
+		ClientIp: e.ClientIp,
+		CreateMs: e.CreatedAt.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// groupUserExpiriesFromRequest converts the optional per-user expiry map
+// carried on AddGroupUsersRequest/PromoteGroupUsersRequest (unix seconds,
+// keyed by user id) into the map the core functions and the reaper expect.
+// Invalid user ids are skipped rather than failing the whole request, since
+// the id list has already been validated above.
+func groupUserExpiriesFromRequest(in map[string]int64) map[uuid.UUID]time.Time {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[uuid.UUID]time.Time, len(in))
+	for idStr, unixSec := range in {
+		uid := uuid.FromStringOrNil(idStr)
+		if uuid.Equal(uuid.Nil, uid) || unixSec <= 0 {
+			continue
+		}
+		out[uid] = time.Unix(unixSec, 0).UTC()
+	}
+	return out
+}
+
+func (s *ApiServer) RenewGroupUserRole(ctx context.Context, in *api.RenewGroupUserRoleRequest) (*empty.Empty, error) {
+	if in.GetGroupId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be set.")
+	}
+	if in.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "User ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+	targetUserID, err := uuid.FromString(in.GetUserId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "User ID must be a valid ID.")
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	// Before hook.
+	if fn := s.runtime.beforeReqFunctions.beforeRenewGroupUserRoleFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-before.Nakama.RenewGroupUserRole"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		result, err, code := fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, in)
+		if err != nil {
+			return nil, status.Error(code, err.Error())
+		}
+		if result == nil {
+			return nil, status.Error(codes.Internal, "Runtime Before hook returned no result.")
+		}
+		in = result
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to renew a user's role.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to renew group user role.")
+	}
+
+	var newExpiresAt *time.Time
+	if in.GetExpiresAt() > 0 {
+		t := time.Unix(in.GetExpiresAt(), 0).UTC()
+		newExpiresAt = &t
+	}
+
+	if err := RenewGroupUserRole(s.logger, s.db, s.groupReaper, groupID, targetUserID, newExpiresAt); err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to renew group user role.")
+	}
+
+	// After hook.
+	if fn := s.runtime.afterReqFunctions.afterRenewGroupUserRoleFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-after.Nakama.RenewGroupUserRole"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, &empty.Empty{})
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("RenewGroupUserRole", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
+	return &empty.Empty{}, nil
+}
+
+// notifyGroupJoinRequestCreated fans a notification out to the requester and
+// to every admin of the group, reusing the existing notification pipeline
+// the same way other group state transitions do.
+func (s *ApiServer) notifyGroupJoinRequestCreated(ctx context.Context, groupID, requesterID uuid.UUID) {
+	s.notifyGroupJoinRequestTransition(ctx, groupID, requesterID, "group_join_request_created", "Your request to join the group is pending approval.")
+}
+
+func (s *ApiServer) notifyGroupJoinRequestTransition(ctx context.Context, groupID, requesterID uuid.UUID, code, content string) {
+	adminIDs, err := listGroupAdminIds(s.db, groupID)
+	if err != nil {
+		s.logger.Warn("Error listing group admins to notify", zap.Error(err), zap.String("group_id", groupID.String()))
+		return
+	}
+
+	now, _ := ptypes.TimestampProto(time.Now().UTC())
+	notifications := make(map[uuid.UUID][]*api.Notification, len(adminIDs)+1)
+	notifications[requesterID] = append(notifications[requesterID], &api.Notification{
+		Subject:    code,
+		Content:    content,
+		Code:       NotificationCodeGroupJoinRequest,
+		SenderId:   groupID.String(),
+		Persistent: true,
+		CreateTime: now,
+	})
+	for _, adminID := range adminIDs {
+		notifications[adminID] = append(notifications[adminID], &api.Notification{
+			Subject:    code,
+			Content:    content,
+			Code:       NotificationCodeGroupJoinRequest,
+			SenderId:   groupID.String(),
+			Persistent: true,
+			CreateTime: now,
+		})
+	}
+
+	if err := NotificationSend(s.logger, s.db, notifications); err != nil {
+		s.logger.Warn("Error sending group join request notifications", zap.Error(err))
+	}
+}
+
+func (s *ApiServer) ListGroupJoinRequests(ctx context.Context, in *api.ListGroupJoinRequestsRequest) (*api.GroupJoinRequestList, error) {
+	if in.GetGroupId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+
+	limit := 100
+	if in.GetLimit() != nil {
+		limit = int(in.GetLimit().Value)
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to list join requests.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to list group join requests.")
+	}
+
+	// Before hook.
+	if fn := s.runtime.beforeReqFunctions.beforeListGroupJoinRequestsFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-before.Nakama.ListGroupJoinRequests"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		result, err, code := fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, in)
+		if err != nil {
+			return nil, status.Error(code, err.Error())
+		}
+		if result == nil {
+			return nil, status.Error(codes.Internal, "Runtime Before hook returned no result.")
+		}
+		in = result
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	requests, cursor, err := ListGroupJoinRequests(s.logger, s.db, groupID, limit, in.GetCursor())
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Error while trying to list group join requests.")
+	}
+
+	out := make([]*api.GroupJoinRequestEntry, 0, len(requests))
+	for _, r := range requests {
+		out = append(out, &api.GroupJoinRequestEntry{
+			UserId:        r.UserId.String(),
+			Message:       r.Message,
+			RequestedRole: int32(r.RequestedRole),
+		})
+	}
+
+	list := &api.GroupJoinRequestList{GroupId: groupID.String(), Requests: out, Cursor: cursor}
+
+	// After hook.
+	if fn := s.runtime.afterReqFunctions.afterListGroupJoinRequestsFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-after.Nakama.ListGroupJoinRequests"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, list)
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("ListGroupJoinRequests", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, list)
+
+	return list, nil
+}
+
+func (s *ApiServer) ApproveGroupJoinRequest(ctx context.Context, in *api.ApproveGroupJoinRequestRequest) (*empty.Empty, error) {
+	if in.GetGroupId() == "" || in.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID and User ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+	requesterID, err := uuid.FromString(in.GetUserId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "User ID must be a valid ID.")
+	}
+
+	assignedRole := 2
+	if in.GetAssignedRole() != 0 {
+		assignedRole = int(in.GetAssignedRole())
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to approve join requests.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to approve group join request.")
+	}
+
+	// Before hook.
+	if fn := s.runtime.beforeReqFunctions.beforeApproveGroupJoinRequestFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-before.Nakama.ApproveGroupJoinRequest"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		result, err, code := fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, in)
+		if err != nil {
+			return nil, status.Error(code, err.Error())
+		}
+		if result == nil {
+			return nil, status.Error(codes.Internal, "Runtime Before hook returned no result.")
+		}
+		in = result
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	if err := ApproveGroupJoinRequest(s.logger, s.db, groupID, requesterID, assignedRole); err != nil {
+		if err == ErrGroupJoinRequestNotFound {
+			return nil, status.Error(codes.NotFound, "Group join request not found.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to approve group join request.")
+	}
+
+	s.publishGroupEvent(ctx, groupID, userID, GroupEventActionJoin, nil, requesterID.String())
+	s.notifyGroupJoinRequestTransition(ctx, groupID, requesterID, "group_join_request_approved", "Your request to join the group was approved.")
+
+	// After hook.
+	if fn := s.runtime.afterReqFunctions.afterApproveGroupJoinRequestFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-after.Nakama.ApproveGroupJoinRequest"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, &empty.Empty{})
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("ApproveGroupJoinRequest", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
+	return &empty.Empty{}, nil
+}
+
+func (s *ApiServer) RejectGroupJoinRequest(ctx context.Context, in *api.RejectGroupJoinRequestRequest) (*empty.Empty, error) {
+	if in.GetGroupId() == "" || in.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID and User ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+	requesterID, err := uuid.FromString(in.GetUserId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "User ID must be a valid ID.")
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to reject join requests.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to reject group join request.")
+	}
+
+	// Before hook.
+	if fn := s.runtime.beforeReqFunctions.beforeRejectGroupJoinRequestFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-before.Nakama.RejectGroupJoinRequest"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		result, err, code := fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, in)
+		if err != nil {
+			return nil, status.Error(code, err.Error())
+		}
+		if result == nil {
+			return nil, status.Error(codes.Internal, "Runtime Before hook returned no result.")
+		}
+		in = result
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	if err := RejectGroupJoinRequest(s.logger, s.db, groupID, requesterID); err != nil {
+		if err == ErrGroupJoinRequestNotFound {
+			return nil, status.Error(codes.NotFound, "Group join request not found.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to reject group join request.")
+	}
+
+	content := "Your request to join the group was rejected."
+	if in.GetReason() != "" {
+		content = content + " Reason: " + in.GetReason()
+	}
+	s.notifyGroupJoinRequestTransition(ctx, groupID, requesterID, "group_join_request_rejected", content)
+
+	// After hook.
+	if fn := s.runtime.afterReqFunctions.afterRejectGroupJoinRequestFunction; fn != nil {
+		// Stats measurement start boundary.
+		name := "nakama.api-after.Nakama.RejectGroupJoinRequest"
+		statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, name), tag.Upsert(MetricsGrpcCode, codes.OK.String()))
+		startNanos := time.Now().UTC().UnixNano()
+		span := trace.NewSpan(name, nil, trace.StartOptions{})
+
+		// Extract request information and execute the hook.
+		clientIP, clientPort := extractClientAddress(s.logger, ctx)
+		fn(s.logger, userID.String(), ctx.Value(ctxUsernameKey{}).(string), ctx.Value(ctxExpiryKey{}).(int64), clientIP, clientPort, &empty.Empty{})
+
+		// Stats measurement end boundary.
+		span.End()
+		stats.Record(statsCtx, MetricsApiTimeSpentMsec.M(float64(time.Now().UTC().UnixNano()-startNanos)/1000), MetricsApiCount.M(1))
+	}
+
+	clientIP, clientPort := extractClientAddress(s.logger, ctx)
+	s.natsPublisher.Publish("RejectGroupJoinRequest", userID.String(), ctx.Value(ctxUsernameKey{}).(string), clientIP, clientPort, in, &empty.Empty{})
+
+	return &empty.Empty{}, nil
+}
+
+func (s *ApiServer) ExportGroup(ctx context.Context, in *api.ExportGroupRequest) (*api.GroupSnapshot, error) {
+	if in.GetGroupId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be set.")
+	}
+
+	groupID, err := uuid.FromString(in.GetGroupId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Group ID must be a valid ID.")
+	}
+
+	userID := ctx.Value(ctxUserIDKey{}).(uuid.UUID)
+
+	if err := requireGroupAdmin(s.db, groupID, userID); err != nil {
+		if err == ErrGroupPermissionDenied {
+			return nil, status.Error(codes.PermissionDenied, "You must be an admin of the group to export it.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to export group.")
+	}
+
+	blob, err := ExportGroup(s.logger, s.db, groupID, in.GetCompress())
+	if err != nil {
+		if err == ErrGroupNotFound {
+			return nil, status.Error(codes.NotFound, "Group not found.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to export group.")
+	}
+
+	return &api.GroupSnapshot{Data: blob}, nil
+}
+
+func (s *ApiServer) ImportGroup(ctx context.Context, in *api.ImportGroupRequest) (*api.Group, error) {
+	if len(in.GetSnapshot().GetData()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot data must be set.")
+	}
+
+	options := GroupSnapshotOptions{
+		// This RPC is reachable by any authenticated client, which has no
+		// superadmin/console concept to gate on - so Force-overwriting an
+		// existing group id is never honored here regardless of what the
+		// request asked for. Restoring in place is a console-only operation
+		// outside this client-facing ApiServer.
+		Force:         false,
+		OnMissingUser: GroupSnapshotOnMissingUser(in.GetOnMissingUser()),
+	}
+	if options.OnMissingUser == "" {
+		options.OnMissingUser = GroupSnapshotOnMissingUserSkip
+	}
+
+	groupID, err := ImportGroup(s.logger, s.db, in.GetSnapshot().GetData(), options)
+	if err != nil {
+		if err == ErrGroupSnapshotInvalid {
+			return nil, status.Error(codes.InvalidArgument, "Snapshot data is invalid or corrupt.")
+		}
+		return nil, status.Error(codes.Internal, "Error while trying to import group.")
+	}
+
+	group, err := getGroup(s.db, groupID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Group imported but could not be reloaded.")
+	}
+	return group, nil
+}
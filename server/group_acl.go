@@ -0,0 +1,283 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/heroiclabs/nakama/api"
+	"go.uber.org/zap"
+)
+
+// GroupAclAction identifies the group operation an ACL rule applies to.
+type GroupAclAction string
+
+const (
+	GroupAclActionJoin       GroupAclAction = "join"
+	GroupAclActionAdd        GroupAclAction = "add"
+	GroupAclActionKick       GroupAclAction = "kick"
+	GroupAclActionPromote    GroupAclAction = "promote"
+	GroupAclActionUpdate     GroupAclAction = "update"
+	GroupAclActionListUsers  GroupAclAction = "list_users"
+	GroupAclActionPostChat   GroupAclAction = "post_chat"
+	GroupAclActionStorageWrite GroupAclAction = "storage_write"
+)
+
+// GroupAclEffect is the outcome applied once a rule's condition matches.
+// Deny always terminates the request. Allow grants the action outright,
+// overriding the role-based default (e.g. requireGroupAdmin) each call site
+// would otherwise fall back to. RequireApproval only applies to JoinGroup,
+// where it queues a pending GroupJoinRequest even for an open group.
+type GroupAclEffect string
+
+const (
+	GroupAclEffectAllow          GroupAclEffect = "allow"
+	GroupAclEffectDeny           GroupAclEffect = "deny"
+	GroupAclEffectRequireApproval GroupAclEffect = "require_approval"
+)
+
+// GroupAclCondition is a single match clause evaluated against the requester's
+// attributes. Only non-empty fields are considered; a rule with no fields set
+// always matches.
+type GroupAclCondition struct {
+	RequesterRole   *int                `json:"requester_role,omitempty"`
+	UserMetadataKey string              `json:"user_metadata_key,omitempty"`
+	UserMetadataVal string              `json:"user_metadata_val,omitempty"`
+	LangTag         string              `json:"lang_tag,omitempty"`
+	ClientIpCidr    string              `json:"client_ip_cidr,omitempty"`
+	MinMembershipAgeSec int64           `json:"min_membership_age_sec,omitempty"`
+}
+
+// GroupAclRule is one ordered entry of a group's extended ACL. Rules are
+// evaluated top-to-bottom by EvaluateGroupAcl and the first match decides.
+type GroupAclRule struct {
+	Action    GroupAclAction    `json:"action"`
+	Condition GroupAclCondition `json:"condition"`
+	Effect    GroupAclEffect    `json:"effect"`
+}
+
+// GroupAcl is the ordered list of rules persisted alongside a group row.
+type GroupAcl struct {
+	GroupId uuid.UUID      `json:"group_id"`
+	Rules   []GroupAclRule `json:"rules"`
+}
+
+// GroupAclContext carries the request attributes EvaluateGroupAcl matches
+// rules against. Callers populate whichever fields are available to them.
+type GroupAclContext struct {
+	RequesterRole     int
+	UserMetadata      map[string]string
+	LangTag           string
+	ClientIp          string
+	MembershipAgeSec  int64
+}
+
+// GroupAclDecision is the result of evaluating a group's ACL for a given
+// action. MatchedRuleIndex is -1 when no rule matched and the role-based
+// default fallback applies, so operators can audit which rule (if any) fired.
+type GroupAclDecision struct {
+	Effect           GroupAclEffect
+	MatchedRuleIndex int
+}
+
+var ErrGroupAclNotFound = "group acl not found"
+
+// EvaluateGroupAcl walks the rules in order and returns the first match. If
+// no rule matches any, Effect is empty and MatchedRuleIndex is -1 so the
+// caller falls back to the existing hardcoded role-based model.
+func EvaluateGroupAcl(acl *GroupAcl, action GroupAclAction, aclCtx GroupAclContext) GroupAclDecision {
+	if acl == nil {
+		return GroupAclDecision{MatchedRuleIndex: -1}
+	}
+
+	for i, rule := range acl.Rules {
+		if rule.Action != action {
+			continue
+		}
+		if !matchGroupAclCondition(rule.Condition, aclCtx) {
+			continue
+		}
+		return GroupAclDecision{Effect: rule.Effect, MatchedRuleIndex: i}
+	}
+
+	return GroupAclDecision{MatchedRuleIndex: -1}
+}
+
+func matchGroupAclCondition(cond GroupAclCondition, aclCtx GroupAclContext) bool {
+	if cond.RequesterRole != nil && *cond.RequesterRole != aclCtx.RequesterRole {
+		return false
+	}
+	if cond.UserMetadataKey != "" {
+		if v, ok := aclCtx.UserMetadata[cond.UserMetadataKey]; !ok || v != cond.UserMetadataVal {
+			return false
+		}
+	}
+	if cond.LangTag != "" && cond.LangTag != aclCtx.LangTag {
+		return false
+	}
+	if cond.ClientIpCidr != "" {
+		_, ipNet, err := net.ParseCIDR(cond.ClientIpCidr)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(aclCtx.ClientIp)
+		if ip == nil || !ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if cond.MinMembershipAgeSec > 0 && aclCtx.MembershipAgeSec < cond.MinMembershipAgeSec {
+		return false
+	}
+	return true
+}
+
+// GetGroupAcl loads the extended ACL rules persisted alongside the group row.
+// It returns (nil, nil) when the group has no ACL configured so callers can
+// fall back to the default role-based model.
+func GetGroupAcl(logger *zap.Logger, db *sql.DB, groupID uuid.UUID) (*GroupAcl, error) {
+	var aclJSON sql.NullString
+	query := "SELECT acl FROM groups WHERE id = $1"
+	if err := db.QueryRow(query, groupID).Scan(&aclJSON); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrGroupNotFound
+		}
+		logger.Error("Error loading group acl", zap.Error(err))
+		return nil, err
+	}
+
+	if !aclJSON.Valid || aclJSON.String == "" {
+		return nil, nil
+	}
+
+	acl := &GroupAcl{GroupId: groupID}
+	if err := json.Unmarshal([]byte(aclJSON.String), &acl.Rules); err != nil {
+		logger.Error("Error unmarshalling group acl", zap.Error(err))
+		return nil, err
+	}
+	return acl, nil
+}
+
+// SetGroupAcl persists the ordered rule list for a group, replacing any
+// rules previously set.
+func SetGroupAcl(logger *zap.Logger, db *sql.DB, userID, groupID uuid.UUID, rules []GroupAclRule) error {
+	rulesJSON, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE groups SET acl = $1, update_time = now() WHERE id = $2"
+	res, err := db.Exec(query, string(rulesJSON), groupID)
+	if err != nil {
+		logger.Error("Error setting group acl", zap.Error(err))
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+// aclRulesToApi converts the storage representation to the wire type used by
+// GetGroupAcl/SetGroupAcl RPC responses.
+func aclRulesToApi(rules []GroupAclRule) []*api.GroupAclRule {
+	out := make([]*api.GroupAclRule, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, &api.GroupAclRule{
+			Action:    string(r.Action),
+			Condition: groupAclConditionToApi(r.Condition),
+			Effect:    string(r.Effect),
+		})
+	}
+	return out
+}
+
+// groupAclConditionFromApi converts the wire condition type accepted by
+// SetGroupAcl into the storage representation. A nil cond (the field wasn't
+// set) round-trips to a zero-value GroupAclCondition, i.e. a rule that always
+// matches.
+func groupAclConditionFromApi(cond *api.GroupAclCondition) GroupAclCondition {
+	if cond == nil {
+		return GroupAclCondition{}
+	}
+
+	out := GroupAclCondition{
+		UserMetadataKey:     cond.GetUserMetadataKey(),
+		UserMetadataVal:     cond.GetUserMetadataVal(),
+		LangTag:             cond.GetLangTag(),
+		ClientIpCidr:        cond.GetClientIpCidr(),
+		MinMembershipAgeSec: cond.GetMinMembershipAgeSec(),
+	}
+	if role := cond.GetRequesterRole(); role != nil {
+		v := int(role.GetValue())
+		out.RequesterRole = &v
+	}
+	return out
+}
+
+// groupAclConditionToApi is the inverse of groupAclConditionFromApi, used to
+// render a persisted rule back out through GetGroupAcl.
+func groupAclConditionToApi(cond GroupAclCondition) *api.GroupAclCondition {
+	out := &api.GroupAclCondition{
+		UserMetadataKey:     cond.UserMetadataKey,
+		UserMetadataVal:     cond.UserMetadataVal,
+		LangTag:             cond.LangTag,
+		ClientIpCidr:        cond.ClientIpCidr,
+		MinMembershipAgeSec: cond.MinMembershipAgeSec,
+	}
+	if cond.RequesterRole != nil {
+		out.RequesterRole = &wrappers.Int32Value{Value: int32(*cond.RequesterRole)}
+	}
+	return out
+}
+
+// groupAclRequesterAttributes loads the caller's role, membership age and
+// profile fields inside groupID, so EvaluateGroupAcl's condition matchers
+// beyond ClientIp (RequesterRole, UserMetadata, LangTag, MembershipAgeSec)
+// have real data to compare against instead of zero values. A user who isn't
+// a member yet (e.g. evaluating GroupAclActionJoin) gets a role of -1, which
+// no RequesterRole condition matches, and a zero membership age, so only
+// rules that don't care about either can match.
+func groupAclRequesterAttributes(db *sql.DB, groupID, userID uuid.UUID) (role int, membershipAgeSec int64, metadata map[string]string, langTag string, err error) {
+	var createTime time.Time
+	edgeErr := db.QueryRow(`SELECT state, create_time FROM group_edge WHERE source_id = $1 AND destination_id = $2`, groupID, userID).Scan(&role, &createTime)
+	if edgeErr != nil && edgeErr != sql.ErrNoRows {
+		return 0, 0, nil, "", edgeErr
+	}
+	if edgeErr == sql.ErrNoRows {
+		// State 0 is superadmin, so a non-member must not keep the zero value.
+		role = -1
+	}
+	if edgeErr == nil {
+		membershipAgeSec = int64(time.Since(createTime).Seconds())
+	}
+
+	var metadataJSON sql.NullString
+	userErr := db.QueryRow(`SELECT metadata, lang_tag FROM users WHERE id = $1`, userID).Scan(&metadataJSON, &langTag)
+	if userErr != nil && userErr != sql.ErrNoRows {
+		return 0, 0, nil, "", userErr
+	}
+	if metadataJSON.Valid && metadataJSON.String != "" {
+		if err := json.Unmarshal([]byte(metadataJSON.String), &metadata); err != nil {
+			return 0, 0, nil, "", err
+		}
+	}
+
+	return role, membershipAgeSec, metadata, langTag, nil
+}
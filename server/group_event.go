@@ -0,0 +1,272 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+// GroupEventAction identifies which group mutation produced an event.
+type GroupEventAction string
+
+const (
+	GroupEventActionCreate  GroupEventAction = "create"
+	GroupEventActionUpdate  GroupEventAction = "update"
+	GroupEventActionDelete  GroupEventAction = "delete"
+	GroupEventActionJoin    GroupEventAction = "join"
+	GroupEventActionLeave   GroupEventAction = "leave"
+	GroupEventActionAdd     GroupEventAction = "add_users"
+	GroupEventActionKick    GroupEventAction = "kick_users"
+	GroupEventActionPromote GroupEventAction = "promote_users"
+
+	// GroupEventActionAclEvaluate records which extended ACL rule matched a
+	// request, for auditability of the match-condition feature. Requests that
+	// match no rule produce no such event.
+	GroupEventActionAclEvaluate GroupEventAction = "acl_evaluate"
+)
+
+// GroupEvent is a single immutable audit record for a group mutation.
+type GroupEvent struct {
+	Id        uuid.UUID        `json:"id"`
+	GroupId   uuid.UUID        `json:"group_id"`
+	ActorId   uuid.UUID        `json:"actor_id"`
+	Action    GroupEventAction `json:"action"`
+	Before    json.RawMessage  `json:"before,omitempty"`
+	After     json.RawMessage  `json:"after,omitempty"`
+	ClientIp  string           `json:"client_ip"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// GroupEventSink persists or forwards group events. The default sink writes
+// to Postgres; operators may register additional sinks (Kafka, NATS) to pipe
+// activity into external SIEM/analytics pipelines.
+type GroupEventSink interface {
+	Write(event *GroupEvent) error
+}
+
+// GroupEventListener matches the signature runtime modules register through
+// RegisterGroupEventListener, mirroring the existing before/after hook shape.
+type GroupEventListener func(event *GroupEvent)
+
+// GroupEventBus fans a published event out to all registered in-process
+// listeners and to every configured sink. It is the single entry point used
+// by the mutation handlers in api_group.go.
+type GroupEventBus struct {
+	logger *zap.Logger
+	db     *sql.DB
+
+	sync.RWMutex
+	sinks     []GroupEventSink
+	listeners []GroupEventListener
+
+	subsMu sync.RWMutex
+	subs   map[uuid.UUID]map[chan *GroupEvent]struct{}
+}
+
+// NewGroupEventBus creates a bus with the default Postgres sink registered.
+func NewGroupEventBus(logger *zap.Logger, db *sql.DB) *GroupEventBus {
+	bus := &GroupEventBus{
+		logger: logger,
+		db:     db,
+		subs:   make(map[uuid.UUID]map[chan *GroupEvent]struct{}),
+	}
+	bus.sinks = append(bus.sinks, &postgresGroupEventSink{logger: logger, db: db})
+	return bus
+}
+
+// RegisterSink adds an additional event sink, e.g. a Kafka or NATS publisher.
+func (b *GroupEventBus) RegisterSink(sink GroupEventSink) {
+	b.Lock()
+	defer b.Unlock()
+	b.sinks = append(b.sinks, sink)
+}
+
+// RegisterListener adds an in-process listener, used by runtime modules that
+// want to observe group activity the same way they observe before/after
+// hooks.
+func (b *GroupEventBus) RegisterListener(fn GroupEventListener) {
+	b.Lock()
+	defer b.Unlock()
+	b.listeners = append(b.listeners, fn)
+}
+
+// Publish appends the event to every sink and notifies in-process listeners
+// and live StreamGroupEvents subscribers. Sink failures are logged but never
+// block the calling request - the audit trail is best-effort with respect to
+// external systems, durable with respect to Postgres.
+func (b *GroupEventBus) Publish(event *GroupEvent) {
+	b.RLock()
+	sinks := b.sinks
+	listeners := b.listeners
+	b.RUnlock()
+
+	for _, sink := range sinks {
+		if err := sink.Write(event); err != nil {
+			b.logger.Warn("Error writing group event to sink", zap.Error(err), zap.String("group_id", event.GroupId.String()))
+		}
+	}
+
+	for _, fn := range listeners {
+		fn(event)
+	}
+
+	b.subsMu.RLock()
+	for ch := range b.subs[event.GroupId] {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber, drop rather than block the publisher.
+		}
+	}
+	b.subsMu.RUnlock()
+}
+
+// Subscribe registers a channel that receives every future event for
+// groupID. The returned cancel function must be called to unsubscribe.
+func (b *GroupEventBus) Subscribe(groupID uuid.UUID) (<-chan *GroupEvent, func()) {
+	ch := make(chan *GroupEvent, 64)
+
+	b.subsMu.Lock()
+	if b.subs[groupID] == nil {
+		b.subs[groupID] = make(map[chan *GroupEvent]struct{})
+	}
+	b.subs[groupID][ch] = struct{}{}
+	b.subsMu.Unlock()
+
+	cancel := func() {
+		b.subsMu.Lock()
+		delete(b.subs[groupID], ch)
+		b.subsMu.Unlock()
+		close(ch)
+	}
+	return ch, cancel
+}
+
+type postgresGroupEventSink struct {
+	logger *zap.Logger
+	db     *sql.DB
+}
+
+func (p *postgresGroupEventSink) Write(event *GroupEvent) error {
+	query := `INSERT INTO group_events (id, group_id, actor_id, action, before_diff, after_diff, client_ip, create_time)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := p.db.Exec(query, event.Id, event.GroupId, event.ActorId, string(event.Action), []byte(event.Before), []byte(event.After), event.ClientIp, event.CreatedAt)
+	if err != nil {
+		p.logger.Error("Error inserting group event", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// ListGroupEvents returns a cursor-paginated slice of historical audit events
+// for a group, optionally filtered by actor and/or action. The cursor is the
+// create_time of the last returned row, formatted as time.RFC3339Nano - the
+// same scheme ListGroupJoinRequests uses - rather than the event's id, which
+// is a random v4 UUID with no relationship to insertion order.
+func ListGroupEvents(logger *zap.Logger, db *sql.DB, groupID uuid.UUID, actorID *uuid.UUID, action *GroupEventAction, limit int, cursor string) ([]*GroupEvent, string, error) {
+	query := "SELECT id, group_id, actor_id, action, before_diff, after_diff, client_ip, create_time FROM group_events WHERE group_id = $1"
+	params := []interface{}{groupID}
+
+	if actorID != nil {
+		params = append(params, *actorID)
+		query += " AND actor_id = $" + strconv.Itoa(len(params))
+	}
+	if action != nil {
+		params = append(params, string(*action))
+		query += " AND action = $" + strconv.Itoa(len(params))
+	}
+	if cursor != "" {
+		cursorTime, err := time.Parse(time.RFC3339Nano, cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		params = append(params, cursorTime)
+		query += " AND create_time < $" + strconv.Itoa(len(params))
+	}
+	query += " ORDER BY create_time DESC LIMIT " + strconv.Itoa(limit+1)
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Error listing group events", zap.Error(err))
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	events := make([]*GroupEvent, 0, limit)
+	for rows.Next() {
+		e := &GroupEvent{}
+		var action string
+		if err := rows.Scan(&e.Id, &e.GroupId, &e.ActorId, &action, &e.Before, &e.After, &e.ClientIp, &e.CreatedAt); err != nil {
+			return nil, "", err
+		}
+		e.Action = GroupEventAction(action)
+		events = append(events, e)
+	}
+
+	newCursor := ""
+	if len(events) > limit {
+		events = events[:limit]
+		newCursor = events[len(events)-1].CreatedAt.Format(time.RFC3339Nano)
+	}
+	return events, newCursor, nil
+}
+
+// ListGroupEventsSince returns every event for groupID recorded after
+// sinceCursor (a cursor previously handed out by ListGroupEvents, or any
+// event create_time formatted as time.RFC3339Nano; StreamGroupEvents sends
+// hand out no cursor of their own, only create_ms), oldest
+// first. It is used by StreamGroupEvents to replay the gap a resuming
+// client missed while disconnected, before the stream falls through to live
+// events. An empty sinceCursor returns no rows, since there is no gap to
+// replay.
+func ListGroupEventsSince(logger *zap.Logger, db *sql.DB, groupID uuid.UUID, sinceCursor string) ([]*GroupEvent, error) {
+	if sinceCursor == "" {
+		return nil, nil
+	}
+
+	sinceTime, err := time.Parse(time.RFC3339Nano, sinceCursor)
+	if err != nil {
+		logger.Error("Error parsing group event cursor", zap.Error(err))
+		return nil, err
+	}
+
+	query := `SELECT id, group_id, actor_id, action, before_diff, after_diff, client_ip, create_time
+FROM group_events WHERE group_id = $1 AND create_time > $2 ORDER BY create_time ASC`
+	rows, err := db.Query(query, groupID, sinceTime)
+	if err != nil {
+		logger.Error("Error listing group events since cursor", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*GroupEvent, 0)
+	for rows.Next() {
+		e := &GroupEvent{}
+		var action string
+		if err := rows.Scan(&e.Id, &e.GroupId, &e.ActorId, &action, &e.Before, &e.After, &e.ClientIp, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Action = GroupEventAction(action)
+		events = append(events, e)
+	}
+	return events, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+// NotificationCodeGroupJoinRequest is the notification code sent to the
+// requester and to group admins for every join request state transition.
+const NotificationCodeGroupJoinRequest int32 = -3
+
+// listGroupAdminIds returns the user ids of every admin/superadmin in a
+// group, used to fan approval-workflow notifications out to the people who
+// can act on them.
+func listGroupAdminIds(db *sql.DB, groupID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := db.Query(`SELECT destination_id FROM group_edge WHERE source_id = $1 AND state <= 1`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// requireGroupAdmin returns ErrGroupPermissionDenied unless userID holds
+// state <= 1 (admin or superadmin) in groupID, including when userID isn't a
+// member at all. It centralizes the admin check several RPCs in
+// api_group.go need but that core group.go doesn't already enforce for them.
+func requireGroupAdmin(db *sql.DB, groupID, userID uuid.UUID) error {
+	var state int
+	err := db.QueryRow(`SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2`, groupID, userID).Scan(&state)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrGroupPermissionDenied
+		}
+		return err
+	}
+	if state > 1 {
+		return ErrGroupPermissionDenied
+	}
+	return nil
+}
+
+// groupJoinRequestTTL is how long a pending join request on a closed group
+// stays open before the reaper expires it.
+const groupJoinRequestTTL = 7 * 24 * time.Hour
+
+// groupIsOpen reports whether a group accepts join requests without
+// approval, so JoinGroup can decide between an immediate membership edge and
+// a pending GroupJoinRequest.
+func groupIsOpen(db *sql.DB, groupID uuid.UUID) (bool, error) {
+	var open bool
+	if err := db.QueryRow("SELECT open FROM groups WHERE id = $1", groupID).Scan(&open); err != nil {
+		if err == sql.ErrNoRows {
+			return false, ErrGroupNotFound
+		}
+		return false, err
+	}
+	return open, nil
+}
+
+// ErrGroupJoinRequestNotFound is returned when an approve/reject targets a
+// request that no longer exists, either because it was already resolved or
+// because it expired and was reaped.
+var ErrGroupJoinRequestNotFound = errors.New("group join request not found")
+
+// GroupJoinRequest is a pending request to join a closed group, created by
+// JoinGroup in place of an immediate membership edge.
+type GroupJoinRequest struct {
+	GroupId      uuid.UUID
+	UserId       uuid.UUID
+	Message      string
+	RequestedRole int
+	ExpiresAt    time.Time
+	CreateTime   time.Time
+}
+
+// CreateGroupJoinRequest records a pending join request for a closed group.
+// The reaper expires it the same way it expires time-bounded roles.
+func CreateGroupJoinRequest(logger *zap.Logger, db *sql.DB, groupID, userID uuid.UUID, message string, requestedRole int, expiresAt time.Time) error {
+	query := `INSERT INTO group_join_request (group_id, user_id, message, requested_role, expires_at, create_time)
+VALUES ($1, $2, $3, $4, $5, now())
+ON CONFLICT (group_id, user_id) DO UPDATE SET message = excluded.message, requested_role = excluded.requested_role, expires_at = excluded.expires_at`
+	if _, err := db.Exec(query, groupID, userID, message, requestedRole, expiresAt); err != nil {
+		logger.Error("Error creating group join request", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// ListGroupJoinRequests returns a cursor-paginated slice of open requests for
+// a group, oldest first so admins triage in request order.
+func ListGroupJoinRequests(logger *zap.Logger, db *sql.DB, groupID uuid.UUID, limit int, cursor string) ([]*GroupJoinRequest, string, error) {
+	query := "SELECT group_id, user_id, message, requested_role, expires_at, create_time FROM group_join_request WHERE group_id = $1"
+	params := []interface{}{groupID}
+	if cursor != "" {
+		cursorTime, err := time.Parse(time.RFC3339Nano, cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		params = append(params, cursorTime)
+		query += " AND create_time > $" + strconv.Itoa(len(params))
+	}
+	params = append(params, limit+1)
+	query += " ORDER BY create_time ASC LIMIT $" + strconv.Itoa(len(params))
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.Error("Error listing group join requests", zap.Error(err))
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	requests := make([]*GroupJoinRequest, 0, limit)
+	for rows.Next() {
+		r := &GroupJoinRequest{}
+		if err := rows.Scan(&r.GroupId, &r.UserId, &r.Message, &r.RequestedRole, &r.ExpiresAt, &r.CreateTime); err != nil {
+			return nil, "", err
+		}
+		requests = append(requests, r)
+	}
+
+	newCursor := ""
+	if len(requests) > limit {
+		requests = requests[:limit]
+		newCursor = requests[len(requests)-1].CreateTime.Format(time.RFC3339Nano)
+	}
+	return requests, newCursor, nil
+}
+
+// ApproveGroupJoinRequest turns a pending request into a real membership
+// edge with the assigned role and removes the request row. It runs inside a
+// single transaction so a crash can never leave both the request and the
+// edge present, or neither.
+func ApproveGroupJoinRequest(logger *zap.Logger, db *sql.DB, groupID, userID uuid.UUID, assignedRole int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM group_join_request WHERE group_id = $1 AND user_id = $2`, groupID, userID)
+	if err != nil {
+		logger.Error("Error deleting group join request on approve", zap.Error(err))
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrGroupJoinRequestNotFound
+	}
+
+	query := `INSERT INTO group_edge (source_id, destination_id, state, create_time, update_time)
+VALUES ($1, $2, $3, now(), now()), ($2, $1, $3, now(), now())`
+	if _, err := tx.Exec(query, groupID, userID, assignedRole); err != nil {
+		logger.Error("Error inserting group edge on approve", zap.Error(err))
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RejectGroupJoinRequest discards a pending request. The reason is not
+// persisted by this function; callers are expected to relay it through the
+// notification pipeline at the RPC layer.
+func RejectGroupJoinRequest(logger *zap.Logger, db *sql.DB, groupID, userID uuid.UUID) error {
+	res, err := db.Exec(`DELETE FROM group_join_request WHERE group_id = $1 AND user_id = $2`, groupID, userID)
+	if err != nil {
+		logger.Error("Error rejecting group join request", zap.Error(err))
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrGroupJoinRequestNotFound
+	}
+	return nil
+}
+
+// reapExpiredGroupJoinRequests deletes join requests past their TTL. It is
+// invoked by GroupReaper's periodic sweep alongside the time-bounded role
+// reap so both deadline types share one ticker.
+func reapExpiredGroupJoinRequests(logger *zap.Logger, db *sql.DB) ([]*GroupJoinRequest, error) {
+	rows, err := db.Query(`SELECT group_id, user_id, message, requested_role, expires_at, create_time FROM group_join_request WHERE expires_at < now()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []*GroupJoinRequest
+	for rows.Next() {
+		r := &GroupJoinRequest{}
+		if err := rows.Scan(&r.GroupId, &r.UserId, &r.Message, &r.RequestedRole, &r.ExpiresAt, &r.CreateTime); err != nil {
+			return nil, err
+		}
+		expired = append(expired, r)
+	}
+
+	for _, r := range expired {
+		if _, err := db.Exec(`DELETE FROM group_join_request WHERE group_id = $1 AND user_id = $2`, r.GroupId, r.UserId); err != nil {
+			logger.Warn("Error reaping expired group join request", zap.Error(err))
+		}
+	}
+	return expired, nil
+}
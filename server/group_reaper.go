@@ -0,0 +1,274 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+// groupEdgeKey identifies a single membership edge that may carry an expiry.
+type groupEdgeKey struct {
+	GroupId uuid.UUID
+	UserId  uuid.UUID
+}
+
+// GroupReaper demotes or kicks group membership edges once their expires_at
+// deadline passes. Near-term expiries are handled by a per-edge
+// time.AfterFunc timer so they fire promptly; a periodic scan covers the
+// long tail (edges scheduled further out than the timer horizon, and any
+// timer lost across a restart) without requiring the whole table to be
+// walked every tick.
+type GroupReaper struct {
+	logger   *zap.Logger
+	db       *sql.DB
+	events   *GroupEventBus
+	interval time.Duration
+
+	mu     sync.Mutex
+	timers map[groupEdgeKey]*time.Timer
+	stopCh chan struct{}
+}
+
+// NewGroupReaper creates a reaper. Call Start to begin the periodic scan.
+func NewGroupReaper(logger *zap.Logger, db *sql.DB, events *GroupEventBus, interval time.Duration) *GroupReaper {
+	return &GroupReaper{
+		logger:   logger,
+		db:       db,
+		events:   events,
+		interval: interval,
+		timers:   make(map[groupEdgeKey]*time.Timer),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start launches the periodic long-tail sweep. It should be called once from
+// ApiServer's constructor.
+func (r *GroupReaper) Start() {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stopCh:
+				return
+			case <-ticker.C:
+				r.sweep()
+			}
+		}
+	}()
+}
+
+// Stop cancels the periodic scan and every pending near-term timer.
+func (r *GroupReaper) Stop() {
+	close(r.stopCh)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, timer := range r.timers {
+		timer.Stop()
+		delete(r.timers, key)
+	}
+}
+
+// ScheduleExpiry arms or re-arms a near-term timer for a membership edge. If
+// expiresAt is further away than the reaper's scan interval the edge is left
+// for the periodic sweep to pick up, avoiding a pile of long-sleeping timers.
+func (r *GroupReaper) ScheduleExpiry(groupID, userID uuid.UUID, expiresAt time.Time) {
+	key := groupEdgeKey{GroupId: groupID, UserId: userID}
+	delay := time.Until(expiresAt)
+	if delay > r.interval {
+		return
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.timers[key]; ok {
+		existing.Stop()
+	}
+	r.timers[key] = time.AfterFunc(delay, func() {
+		r.reapOne(groupID, userID)
+	})
+}
+
+// CancelExpiry stops a pending near-term timer, used when an admin renews or
+// revokes an expiry early.
+func (r *GroupReaper) CancelExpiry(groupID, userID uuid.UUID) {
+	key := groupEdgeKey{GroupId: groupID, UserId: userID}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if timer, ok := r.timers[key]; ok {
+		timer.Stop()
+		delete(r.timers, key)
+	}
+}
+
+func (r *GroupReaper) reapOne(groupID, userID uuid.UUID) {
+	r.mu.Lock()
+	delete(r.timers, groupEdgeKey{GroupId: groupID, UserId: userID})
+	r.mu.Unlock()
+
+	demoted, kicked, err := reapExpiredGroupEdge(r.logger, r.db, groupID, userID)
+	if err != nil {
+		r.logger.Warn("Error reaping expired group edge", zap.Error(err), zap.String("group_id", groupID.String()), zap.String("user_id", userID.String()))
+		return
+	}
+	r.publishReapEvent(groupID, userID, demoted, kicked)
+}
+
+// sweep demotes expired admins back to member and kicks expired members via
+// sweepExpiredGroupEdges (one query to find them, then one statement per
+// edge, not a single SQL statement), then emits an audit event for each edge
+// it touched. It also reaps expired
+// group join requests, since both deadline types share this one ticker.
+func (r *GroupReaper) sweep() {
+	edges, err := sweepExpiredGroupEdges(r.logger, r.db)
+	if err != nil {
+		r.logger.Error("Error sweeping expired group edges", zap.Error(err))
+		return
+	}
+	for _, edge := range edges {
+		r.publishReapEvent(edge.GroupId, edge.UserId, edge.Demoted, edge.Kicked)
+	}
+
+	if _, err := reapExpiredGroupJoinRequests(r.logger, r.db); err != nil {
+		r.logger.Error("Error sweeping expired group join requests", zap.Error(err))
+	}
+}
+
+func (r *GroupReaper) publishReapEvent(groupID, userID uuid.UUID, demoted, kicked bool) {
+	if r.events == nil {
+		return
+	}
+	action := GroupEventActionKick
+	if demoted {
+		action = GroupEventActionPromote
+	}
+	if !demoted && !kicked {
+		return
+	}
+	r.events.Publish(&GroupEvent{
+		Id:        uuid.Must(uuid.NewV4()),
+		GroupId:   groupID,
+		ActorId:   uuid.Nil,
+		Action:    action,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+type reapedGroupEdge struct {
+	GroupId uuid.UUID
+	UserId  uuid.UUID
+	Demoted bool
+	Kicked  bool
+}
+
+// reapExpiredGroupEdge re-checks and acts on a single edge, used by the
+// near-term timer path where the deadline may have shifted since the timer
+// was armed (e.g. a concurrent renew that raced the timer firing).
+func reapExpiredGroupEdge(logger *zap.Logger, db *sql.DB, groupID, userID uuid.UUID) (demoted, kicked bool, err error) {
+	query := `SELECT state FROM group_edge WHERE source_id = $1 AND destination_id = $2 AND expires_at IS NOT NULL AND expires_at < now()`
+	var state int
+	if err := db.QueryRow(query, groupID, userID).Scan(&state); err != nil {
+		if err == sql.ErrNoRows {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+
+	// State 1 (admin) demotes to member (state 2); all other expired states
+	// are kicked outright since a temporary membership grant has no lower
+	// tier to fall back to.
+	if state == 1 {
+		_, err = db.Exec(`UPDATE group_edge SET state = 2, expires_at = NULL WHERE source_id = $1 AND destination_id = $2`, groupID, userID)
+		return err == nil, false, err
+	}
+
+	_, err = db.Exec(`DELETE FROM group_edge WHERE (source_id = $1 AND destination_id = $2) OR (source_id = $2 AND destination_id = $1)`, groupID, userID)
+	return false, err == nil, err
+}
+
+// sweepExpiredGroupEdges performs the same demote-or-kick decision as
+// reapExpiredGroupEdge across every expired edge, for the periodic long-tail
+// scan: one SELECT finds the expired edges, then each is demoted or kicked
+// with its own UPDATE or DELETE, outside any transaction. A failed per-edge
+// statement is logged and the edge is still reported as touched.
+func sweepExpiredGroupEdges(logger *zap.Logger, db *sql.DB) ([]reapedGroupEdge, error) {
+	rows, err := db.Query(`SELECT source_id, destination_id, state FROM group_edge WHERE expires_at IS NOT NULL AND expires_at < now()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edges []reapedGroupEdge
+	for rows.Next() {
+		var e reapedGroupEdge
+		var state int
+		if err := rows.Scan(&e.GroupId, &e.UserId, &state); err != nil {
+			return nil, err
+		}
+		e.Demoted = state == 1
+		e.Kicked = !e.Demoted
+		edges = append(edges, e)
+	}
+
+	for _, e := range edges {
+		if e.Demoted {
+			if _, err := db.Exec(`UPDATE group_edge SET state = 2, expires_at = NULL WHERE source_id = $1 AND destination_id = $2`, e.GroupId, e.UserId); err != nil {
+				logger.Warn("Error demoting expired group admin", zap.Error(err))
+			}
+			continue
+		}
+		if _, err := db.Exec(`DELETE FROM group_edge WHERE (source_id = $1 AND destination_id = $2) OR (source_id = $2 AND destination_id = $1)`, e.GroupId, e.UserId); err != nil {
+			logger.Warn("Error kicking expired group member", zap.Error(err))
+		}
+	}
+
+	return edges, nil
+}
+
+// RenewGroupUserRole extends an existing expiry on a membership edge and
+// reschedules the reaper timer, or cancels the timer and clears the expiry
+// when newExpiresAt is nil (making the grant permanent).
+func RenewGroupUserRole(logger *zap.Logger, db *sql.DB, reaper *GroupReaper, groupID, userID uuid.UUID, newExpiresAt *time.Time) error {
+	var err error
+	if newExpiresAt == nil {
+		_, err = db.Exec(`UPDATE group_edge SET expires_at = NULL WHERE source_id = $1 AND destination_id = $2`, groupID, userID)
+	} else {
+		_, err = db.Exec(`UPDATE group_edge SET expires_at = $3 WHERE source_id = $1 AND destination_id = $2`, groupID, userID, *newExpiresAt)
+	}
+	if err != nil {
+		logger.Error("Error renewing group user role", zap.Error(err))
+		return err
+	}
+
+	if reaper == nil {
+		return nil
+	}
+	if newExpiresAt == nil {
+		reaper.CancelExpiry(groupID, userID)
+	} else {
+		reaper.ScheduleExpiry(groupID, userID, *newExpiresAt)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/gofrs/uuid"
+	"github.com/heroiclabs/nakama/api"
+	"go.uber.org/zap"
+)
+
+// groupSnapshotMagic identifies an exported group blob so ImportGroup can
+// reject unrelated input before touching the database.
+var groupSnapshotMagic = [4]byte{'N', 'G', 'R', 'P'}
+
+// groupSnapshotVersion is bumped whenever the payload shape changes in a way
+// that ImportGroup needs to branch on.
+const groupSnapshotVersion uint32 = 1
+
+// ErrGroupSnapshotInvalid is returned when an import blob fails the header,
+// checksum, or version check.
+var ErrGroupSnapshotInvalid = errors.New("invalid group snapshot")
+
+// GroupSnapshotOnMissingUser controls how ImportGroup handles membership
+// edges whose user id does not exist on the target instance.
+type GroupSnapshotOnMissingUser string
+
+const (
+	GroupSnapshotOnMissingUserSkip GroupSnapshotOnMissingUser = "skip"
+	GroupSnapshotOnMissingUserStub GroupSnapshotOnMissingUser = "stub"
+	GroupSnapshotOnMissingUserFail GroupSnapshotOnMissingUser = "fail"
+)
+
+// GroupSnapshotMember is one membership edge captured in a snapshot.
+type GroupSnapshotMember struct {
+	UserId   uuid.UUID `json:"user_id"`
+	State    int       `json:"state"`
+	Metadata string    `json:"metadata,omitempty"`
+}
+
+// groupSnapshotPayload is the self-contained, versioned body of an export.
+// It is what the header's checksum is computed over.
+type groupSnapshotPayload struct {
+	Group        *api.Group             `json:"group"`
+	Members      []*GroupSnapshotMember `json:"members"`
+	AclRules     []GroupAclRule         `json:"acl_rules,omitempty"`
+	JoinRequests []*GroupJoinRequest    `json:"join_requests,omitempty"`
+	RecentEvents []*GroupEvent          `json:"recent_events,omitempty"`
+}
+
+// GroupSnapshotOptions controls ImportGroup's behaviour.
+type GroupSnapshotOptions struct {
+	Force         bool
+	OnMissingUser GroupSnapshotOnMissingUser
+}
+
+// maxGroupSnapshotEvents bounds how many recent audit events ride along in
+// an export, so a long-lived group's full history doesn't balloon the blob.
+const maxGroupSnapshotEvents = 200
+
+// ExportGroup produces a self-contained, versioned, optionally gzip
+// compressed blob suitable for offline backup or cross-environment cloning.
+// Layout: 4 byte magic, 4 byte big-endian version, 32 byte SHA-256 checksum
+// of the payload, then the JSON payload itself (gzip-wrapped when
+// compress is true).
+func ExportGroup(logger *zap.Logger, db *sql.DB, groupID uuid.UUID, compress bool) ([]byte, error) {
+	group, err := getGroupForSnapshot(db, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := getGroupMembersForSnapshot(db, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	var aclRules []GroupAclRule
+	if acl, err := GetGroupAcl(logger, db, groupID); err != nil {
+		return nil, err
+	} else if acl != nil {
+		aclRules = acl.Rules
+	}
+
+	joinRequests, _, err := ListGroupJoinRequests(logger, db, groupID, 1000, "")
+	if err != nil {
+		return nil, err
+	}
+
+	events, _, err := ListGroupEvents(logger, db, groupID, nil, nil, maxGroupSnapshotEvents, "")
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &groupSnapshotPayload{
+		Group:        group,
+		Members:      members,
+		AclRules:     aclRules,
+		JoinRequests: joinRequests,
+		RecentEvents: events,
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(payloadJSON); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		payloadJSON = buf.Bytes()
+	}
+
+	checksum := sha256.Sum256(payloadJSON)
+
+	header := make([]byte, 0, 4+4+32)
+	header = append(header, groupSnapshotMagic[:]...)
+	versionBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(versionBytes, groupSnapshotVersion)
+	header = append(header, versionBytes...)
+	header = append(header, checksum[:]...)
+
+	return append(header, payloadJSON...), nil
+}
+
+// ImportGroup restores a group from a blob produced by ExportGroup. When
+// options.Force is false the group is always recreated under a new UUID;
+// superadmins may pass Force to restore over the original id instead.
+// Membership edges for user ids that don't exist on this instance are
+// skipped, stubbed, or treated as a hard failure per options.OnMissingUser.
+func ImportGroup(logger *zap.Logger, db *sql.DB, blob []byte, options GroupSnapshotOptions) (uuid.UUID, error) {
+	if len(blob) < 4+4+32 {
+		return uuid.Nil, ErrGroupSnapshotInvalid
+	}
+	if !bytes.Equal(blob[:4], groupSnapshotMagic[:]) {
+		return uuid.Nil, ErrGroupSnapshotInvalid
+	}
+	version := binary.BigEndian.Uint32(blob[4:8])
+	if version != groupSnapshotVersion {
+		return uuid.Nil, ErrGroupSnapshotInvalid
+	}
+	checksum := blob[8:40]
+	payloadBytes := blob[40:]
+
+	got := sha256.Sum256(payloadBytes)
+	if !bytes.Equal(checksum, got[:]) {
+		return uuid.Nil, ErrGroupSnapshotInvalid
+	}
+
+	if isGzip(payloadBytes) {
+		gz, err := gzip.NewReader(bytes.NewReader(payloadBytes))
+		if err != nil {
+			return uuid.Nil, ErrGroupSnapshotInvalid
+		}
+		defer gz.Close()
+		payloadBytes, err = ioutil.ReadAll(gz)
+		if err != nil {
+			return uuid.Nil, ErrGroupSnapshotInvalid
+		}
+	}
+
+	var payload groupSnapshotPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return uuid.Nil, ErrGroupSnapshotInvalid
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	targetID := uuid.Must(uuid.NewV4())
+	if options.Force {
+		targetID = uuid.FromStringOrNil(payload.Group.GetId())
+	}
+
+	if err := insertGroupForImport(tx, targetID, payload.Group); err != nil {
+		return uuid.Nil, err
+	}
+
+	for _, member := range payload.Members {
+		exists, err := userExists(tx, member.UserId)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if !exists {
+			switch options.OnMissingUser {
+			case GroupSnapshotOnMissingUserSkip:
+				continue
+			case GroupSnapshotOnMissingUserFail:
+				return uuid.Nil, errors.New("group snapshot references missing user " + member.UserId.String())
+			case GroupSnapshotOnMissingUserStub:
+				if err := stubUserForImport(tx, member.UserId); err != nil {
+					return uuid.Nil, err
+				}
+			}
+		}
+		if err := insertGroupEdgeForImport(tx, targetID, member.UserId, member.State); err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	if len(payload.AclRules) > 0 {
+		rulesJSON, err := json.Marshal(payload.AclRules)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if _, err := tx.Exec(`UPDATE groups SET acl = $1 WHERE id = $2`, string(rulesJSON), targetID); err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uuid.Nil, err
+	}
+	return targetID, nil
+}
+
+func isGzip(b []byte) bool {
+	return len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+func getGroupForSnapshot(db *sql.DB, groupID uuid.UUID) (*api.Group, error) {
+	group, err := getGroup(db, groupID)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func getGroupMembersForSnapshot(db *sql.DB, groupID uuid.UUID) ([]*GroupSnapshotMember, error) {
+	rows, err := db.Query(`SELECT destination_id, state FROM group_edge WHERE source_id = $1`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]*GroupSnapshotMember, 0)
+	for rows.Next() {
+		m := &GroupSnapshotMember{}
+		if err := rows.Scan(&m.UserId, &m.State); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func insertGroupForImport(tx *sql.Tx, groupID uuid.UUID, group *api.Group) error {
+	query := `INSERT INTO groups (id, creator_id, name, description, lang_tag, avatar_url, open, edge_count, max_count, create_time, update_time)
+VALUES ($1, $2, $3, $4, $5, $6, $7, 0, $8, now(), now())`
+	_, err := tx.Exec(query, groupID, group.GetCreatorId(), group.GetName(), group.GetDescription(), group.GetLangTag(), group.GetAvatarUrl(), group.GetOpen().GetValue(), group.GetMaxCount())
+	return err
+}
+
+func insertGroupEdgeForImport(tx *sql.Tx, groupID, userID uuid.UUID, state int) error {
+	query := `INSERT INTO group_edge (source_id, destination_id, state, create_time, update_time)
+VALUES ($1, $2, $3, now(), now()), ($2, $1, $3, now(), now())
+ON CONFLICT DO NOTHING`
+	_, err := tx.Exec(query, groupID, userID, state)
+	return err
+}
+
+func userExists(tx *sql.Tx, userID uuid.UUID) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists)
+	return exists, err
+}
+
+func stubUserForImport(tx *sql.Tx, userID uuid.UUID) error {
+	_, err := tx.Exec(`INSERT INTO users (id, username, create_time, update_time) VALUES ($1, $2, now(), now()) ON CONFLICT DO NOTHING`, userID, "stub_"+userID.String()[:8])
+	return err
+}
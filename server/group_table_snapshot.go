@@ -0,0 +1,448 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/heroiclabs/nakama/api"
+	"go.uber.org/zap"
+)
+
+// groupTableSnapshotSchemaVersion is bumped whenever the record shape
+// written by ExportGroupsToWriter changes incompatibly.
+const groupTableSnapshotSchemaVersion = 1
+
+// GroupTableSnapshotManifest accompanies an export so a reader can confirm
+// the dump wasn't truncated or tampered with. ImportGroupsFromReader checks
+// it only after every batch has been applied, so a mismatch is reported
+// after those records are already committed. SchemaVersion is not checked on
+// import.
+type GroupTableSnapshotManifest struct {
+	SchemaVersion int    `json:"schema_version"`
+	GroupCount    int    `json:"group_count"`
+	Checksum      string `json:"checksum"`
+}
+
+// groupTableSnapshotRecord is one line of the dump: a group plus its
+// membership edges, self-contained so import can upsert it independently of
+// record ordering.
+type groupTableSnapshotRecord struct {
+	Group   *api.Group
+	Members []*GroupSnapshotMember
+}
+
+// groupTableSnapshotCheckpoint is persisted after every batch so a resumed
+// export picks up exactly where the previous run left off instead of
+// re-walking groups it already wrote. Count and HasherState let the resumed
+// run's manifest cover the whole file - the part already on disk plus the
+// part it's about to append - rather than just the tail it writes this time.
+type groupTableSnapshotCheckpoint struct {
+	Cursor      string `json:"cursor"`
+	Count       int    `json:"count"`
+	HasherState string `json:"hasher_state,omitempty"`
+}
+
+// ErrGroupTableSnapshotInvalid is returned when an import's manifest
+// checksum doesn't match the payload it accompanies.
+var ErrGroupTableSnapshotInvalid = errors.New("invalid group table snapshot")
+
+// ExportGroupsToWriter walks every group via the same ListGroups cursor
+// pagination the API uses, writing one newline-delimited record per group to
+// w in the format encodeGroupTableSnapshotRecord describes (base64 protobuf
+// group, base64 JSON members). checkpointPath, if non-empty, is updated
+// after every batch and consulted on startup so a killed export can resume
+// instead of restarting from the first group. w is expected to already
+// contain whatever a prior, checkpointed run wrote - resuming replays the
+// hasher and count from the checkpoint rather than recomputing them, since w
+// is only being appended to, not rewritten from scratch.
+func ExportGroupsToWriter(logger *zap.Logger, db *sql.DB, w io.Writer, checkpointPath string, batchSize int) (*GroupTableSnapshotManifest, error) {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	cursor := ""
+	hasher := sha256.New()
+	count := 0
+	if checkpointPath != "" {
+		if cp, err := readGroupTableSnapshotCheckpoint(checkpointPath); err == nil {
+			cursor = cp.Cursor
+			count = cp.Count
+			if cp.HasherState != "" {
+				if state, err := base64.StdEncoding.DecodeString(cp.HasherState); err == nil {
+					if unmarshaler, ok := hasher.(encoding.BinaryUnmarshaler); ok {
+						if err := unmarshaler.UnmarshalBinary(state); err != nil {
+							logger.Warn("Error restoring group snapshot checkpoint hasher state, export checksum will not match prior progress", zap.Error(err))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+
+	for {
+		groups, err := ListGroups(logger, db, "", batchSize, cursor)
+		if err != nil {
+			return nil, err
+		}
+		if len(groups.GetGroups()) == 0 {
+			break
+		}
+
+		for _, group := range groups.GetGroups() {
+			groupID, err := uuid.FromString(group.GetId())
+			if err != nil {
+				return nil, err
+			}
+			members, err := getGroupMembersForSnapshot(db, groupID)
+			if err != nil {
+				return nil, err
+			}
+
+			line, err := encodeGroupTableSnapshotRecord(&groupTableSnapshotRecord{Group: group, Members: members})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := hasher.Write(line); err != nil {
+				return nil, err
+			}
+			if _, err := bw.Write(line); err != nil {
+				return nil, err
+			}
+			if err := bw.WriteByte('\n'); err != nil {
+				return nil, err
+			}
+			count++
+		}
+
+		cursor = groups.GetCursor()
+		if checkpointPath != "" {
+			if err := writeGroupTableSnapshotCheckpoint(checkpointPath, cursor, count, hasher); err != nil {
+				logger.Warn("Error writing group snapshot checkpoint", zap.Error(err))
+			}
+		}
+		if cursor == "" {
+			break
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	manifest := &GroupTableSnapshotManifest{
+		SchemaVersion: groupTableSnapshotSchemaVersion,
+		GroupCount:    count,
+		Checksum:      fmt.Sprintf("%x", hasher.Sum(nil)),
+	}
+
+	if checkpointPath != "" {
+		os.Remove(checkpointPath)
+	}
+	return manifest, nil
+}
+
+// ImportGroupsFromReader restores a dump produced by ExportGroupsToWriter.
+// Records are applied batchSize at a time, each batch in its own
+// transaction, upserting by group ID so importing the same dump twice - or
+// resuming an import that died mid-way - never produces duplicates.
+func ImportGroupsFromReader(logger *zap.Logger, db *sql.DB, r io.Reader, manifest *GroupTableSnapshotManifest, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	hasher := sha256.New()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	batch := make([]*groupTableSnapshotRecord, 0, batchSize)
+	imported := 0
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := importGroupTableSnapshotBatch(db, batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if _, err := hasher.Write(line); err != nil {
+			return err
+		}
+
+		record, err := decodeGroupTableSnapshotRecord(line)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, record)
+
+		if len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		checksum := fmt.Sprintf("%x", hasher.Sum(nil))
+		if checksum != manifest.Checksum {
+			return ErrGroupTableSnapshotInvalid
+		}
+		if manifest.GroupCount != 0 && manifest.GroupCount != imported {
+			return ErrGroupTableSnapshotInvalid
+		}
+	}
+
+	logger.Info("Imported group table snapshot", zap.Int("count", imported))
+	return nil
+}
+
+func importGroupTableSnapshotBatch(db *sql.DB, records []*groupTableSnapshotRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, record := range records {
+		groupID := uuid.FromStringOrNil(record.Group.GetId())
+		if err := upsertGroupForTableSnapshot(tx, groupID, record.Group); err != nil {
+			return err
+		}
+		for _, member := range record.Members {
+			if err := insertGroupEdgeForImport(tx, groupID, member.UserId, member.State); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func upsertGroupForTableSnapshot(tx *sql.Tx, groupID uuid.UUID, group *api.Group) error {
+	query := `INSERT INTO groups (id, creator_id, name, description, lang_tag, avatar_url, open, edge_count, max_count, create_time, update_time)
+VALUES ($1, $2, $3, $4, $5, $6, $7, 0, $8, now(), now())
+ON CONFLICT (id) DO UPDATE SET name = excluded.name, description = excluded.description, lang_tag = excluded.lang_tag,
+  avatar_url = excluded.avatar_url, open = excluded.open, max_count = excluded.max_count, update_time = now()`
+	_, err := tx.Exec(query, groupID, group.GetCreatorId(), group.GetName(), group.GetDescription(), group.GetLangTag(), group.GetAvatarUrl(), group.GetOpen().GetValue(), group.GetMaxCount())
+	return err
+}
+
+// encodeGroupTableSnapshotRecord renders a record as one line: the group's
+// actual protobuf encoding, a space, then its membership edges (which have
+// no corresponding wire message in this package) as JSON - both base64'd so
+// neither half's raw bytes can smuggle in a newline and break line framing.
+func encodeGroupTableSnapshotRecord(record *groupTableSnapshotRecord) ([]byte, error) {
+	groupBytes, err := proto.Marshal(record.Group)
+	if err != nil {
+		return nil, err
+	}
+	membersJSON, err := json.Marshal(record.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	var line bytes.Buffer
+	line.WriteString(base64.StdEncoding.EncodeToString(groupBytes))
+	line.WriteByte(' ')
+	line.WriteString(base64.StdEncoding.EncodeToString(membersJSON))
+	return line.Bytes(), nil
+}
+
+func decodeGroupTableSnapshotRecord(line []byte) (*groupTableSnapshotRecord, error) {
+	parts := bytes.SplitN(line, []byte(" "), 2)
+	if len(parts) != 2 {
+		return nil, ErrGroupTableSnapshotInvalid
+	}
+
+	groupBytes, err := base64.StdEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	group := &api.Group{}
+	if err := proto.Unmarshal(groupBytes, group); err != nil {
+		return nil, err
+	}
+
+	membersJSON, err := base64.StdEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	var members []*GroupSnapshotMember
+	if err := json.Unmarshal(membersJSON, &members); err != nil {
+		return nil, err
+	}
+
+	return &groupTableSnapshotRecord{Group: group, Members: members}, nil
+}
+
+func readGroupTableSnapshotCheckpoint(path string) (*groupTableSnapshotCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp groupTableSnapshotCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func writeGroupTableSnapshotCheckpoint(path, cursor string, count int, hasher hash.Hash) error {
+	cp := &groupTableSnapshotCheckpoint{Cursor: cursor, Count: count}
+	if marshaler, ok := hasher.(encoding.BinaryMarshaler); ok {
+		if state, err := marshaler.MarshalBinary(); err == nil {
+			cp.HasherState = base64.StdEncoding.EncodeToString(state)
+		}
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// groupTableSnapshotManifestSuffix is appended to the data file's path to
+// derive the manifest's path, so `nakama groups snapshot export foo.ndjson` always
+// leaves `foo.ndjson.manifest.json` next to it without a separate flag.
+const groupTableSnapshotManifestSuffix = ".manifest.json"
+
+// ExportGroupsToPath exports every group to path and writes its manifest
+// alongside it. This is the entry point both the CLI subcommand and the
+// runtime-callable function below delegate to.
+func ExportGroupsToPath(logger *zap.Logger, db *sql.DB, path string, batchSize int) (*GroupTableSnapshotManifest, error) {
+	checkpointPath := path + ".checkpoint"
+
+	// A surviving checkpoint means path already holds whatever a prior,
+	// interrupted run wrote - open for append so ExportGroupsToWriter resumes
+	// the file in place instead of silently discarding it. Only a fresh
+	// export (no checkpoint) truncates, since there's nothing worth keeping.
+	flags := os.O_WRONLY | os.O_CREATE
+	if _, err := os.Stat(checkpointPath); err == nil {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest, err := ExportGroupsToWriter(logger, db, f, checkpointPath, batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path+groupTableSnapshotManifestSuffix, manifestJSON, 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ImportGroupsFromPath restores the dump at path, reading its manifest from
+// the conventional sibling path if present.
+func ImportGroupsFromPath(logger *zap.Logger, db *sql.DB, path string, batchSize int) error {
+	var manifest *GroupTableSnapshotManifest
+	if manifestJSON, err := ioutil.ReadFile(path + groupTableSnapshotManifestSuffix); err == nil {
+		manifest = &GroupTableSnapshotManifest{}
+		if err := json.Unmarshal(manifestJSON, manifest); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return ImportGroupsFromReader(logger, db, f, manifest, batchSize)
+}
+
+// RunGroupSnapshotCmd implements the `nakama groups snapshot` CLI
+// subcommand: `groups snapshot export <path>` or `groups snapshot import
+// <path>`, each using ExportGroupsToPath/ImportGroupsFromPath so the CLI and
+// the runtime-callable function below stay in lockstep.
+func RunGroupSnapshotCmd(logger *zap.Logger, db *sql.DB, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: groups snapshot <export|import> <path>")
+	}
+
+	switch args[0] {
+	case "export":
+		manifest, err := ExportGroupsToPath(logger, db, args[1], 0)
+		if err != nil {
+			return err
+		}
+		logger.Info("Exported group table snapshot", zap.Int("count", manifest.GroupCount), zap.String("path", args[1]))
+		return nil
+	case "import":
+		if err := ImportGroupsFromPath(logger, db, args[1], 0); err != nil {
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown groups snapshot subcommand %q", args[0])
+	}
+}
+
+// GroupsSnapshotExportRuntimeFn is the signature the Lua/Go runtime bridge
+// registers as a callable function (e.g. nk.groups_snapshot_export(path)) so
+// operators can trigger a snapshot from inside a scheduled match or RPC
+// handler ahead of a destructive migration.
+type GroupsSnapshotExportRuntimeFn func(path string) (*GroupTableSnapshotManifest, error)
+
+// NewGroupsSnapshotExportRuntimeFn binds logger/db into a closure matching
+// GroupsSnapshotExportRuntimeFn, ready to hand to the runtime registry.
+func NewGroupsSnapshotExportRuntimeFn(logger *zap.Logger, db *sql.DB) GroupsSnapshotExportRuntimeFn {
+	return func(path string) (*GroupTableSnapshotManifest, error) {
+		return ExportGroupsToPath(logger, db, path, 0)
+	}
+}
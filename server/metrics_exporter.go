@@ -0,0 +1,264 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	prometheus "contrib.go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+)
+
+// MetricsGrpcCode tags a recorded measurement with the gRPC status code the
+// call returned, so the exporters in this file can break down latency and
+// count by outcome as well as by RPC name. The before/after hook stats.Record
+// call sites in api_group.go upsert this tag alongside MetricsFunction; it is
+// always codes.OK there since a hook that returns early on error never
+// reaches its stats.Record line.
+var MetricsGrpcCode = tag.MustNewKey("grpc_code")
+
+func init() {
+	view.Register(
+		&view.View{
+			Name:        "nakama/api_count_by_code",
+			Measure:     MetricsApiCount,
+			Description: "Count of API calls by RPC name and gRPC status code",
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{MetricsFunction, MetricsGrpcCode},
+		},
+		&view.View{
+			Name:        "nakama/api_latency_by_code",
+			Measure:     MetricsApiTimeSpentMsec,
+			Description: "Distribution of API call latency (ms) by RPC name and gRPC status code",
+			Aggregation: view.Distribution(1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000),
+			TagKeys:     []tag.Key{MetricsFunction, MetricsGrpcCode},
+		},
+	)
+}
+
+// NewPrometheusMetricsHandler builds the /metrics scrape endpoint. The
+// returned handler should be mounted on the same mux the API gateway already
+// serves grpc-gateway traffic from.
+func NewPrometheusMetricsHandler(namespace string) (http.Handler, error) {
+	exporter, err := prometheus.NewExporter(prometheus.Options{Namespace: namespace})
+	if err != nil {
+		return nil, err
+	}
+	view.RegisterExporter(exporter)
+	return exporter, nil
+}
+
+// InfluxPushExporterConfig is loaded from the metrics section of server.yml.
+type InfluxPushExporterConfig struct {
+	Address       string
+	Database      string
+	NodeId        string
+	FlushInterval time.Duration
+	MaxBatchBytes int
+	Gzip          bool
+}
+
+// InfluxPushExporter periodically reads the registered OpenCensus views and
+// pushes them to an InfluxDB instance as line protocol, batching points up to
+// MaxBatchBytes per write so a single slow flush can't grow without bound.
+type InfluxPushExporter struct {
+	logger *zap.Logger
+	config InfluxPushExporterConfig
+	client *http.Client
+
+	bufPool sync.Pool
+}
+
+// NewInfluxPushExporter constructs a pusher. Call Start to begin the flush
+// loop; it does not push anything until then.
+func NewInfluxPushExporter(logger *zap.Logger, config InfluxPushExporterConfig) *InfluxPushExporter {
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 10 * time.Second
+	}
+	if config.MaxBatchBytes <= 0 {
+		config.MaxBatchBytes = 64 * 1024
+	}
+	return &InfluxPushExporter{
+		logger: logger,
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		bufPool: sync.Pool{
+			New: func() interface{} { return new(bytes.Buffer) },
+		},
+	}
+}
+
+// Start runs the flush loop until ctx is cancelled, at which point it drains
+// one final time before returning.
+func (e *InfluxPushExporter) Start(ctx context.Context) {
+	ticker := time.NewTicker(e.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.flush()
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+func (e *InfluxPushExporter) flush() {
+	points := e.collectPoints()
+	if len(points) == 0 {
+		return
+	}
+
+	buf := e.bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer e.bufPool.Put(buf)
+
+	for _, point := range points {
+		if buf.Len()+len(point) > e.config.MaxBatchBytes {
+			if err := e.write(buf.Bytes()); err != nil {
+				e.logger.Warn("Error pushing metrics to influx", zap.Error(err))
+			}
+			buf.Reset()
+		}
+		buf.WriteString(point)
+		buf.WriteByte('\n')
+	}
+	if buf.Len() > 0 {
+		if err := e.write(buf.Bytes()); err != nil {
+			e.logger.Warn("Error pushing metrics to influx", zap.Error(err))
+		}
+	}
+}
+
+// collectPoints renders every row of the count/latency views as an
+// InfluxDB line protocol point keyed by measurement nakama_api.
+func (e *InfluxPushExporter) collectPoints() []string {
+	countRows, err := view.RetrieveData("nakama/api_count_by_code")
+	if err != nil {
+		e.logger.Warn("Error retrieving api count view data", zap.Error(err))
+		countRows = nil
+	}
+	latencyRows, err := view.RetrieveData("nakama/api_latency_by_code")
+	if err != nil {
+		e.logger.Warn("Error retrieving api latency view data", zap.Error(err))
+		latencyRows = nil
+	}
+
+	fields := make(map[influxRowKey]map[string]float64)
+
+	for _, row := range countRows {
+		k := rowKey(row.Tags)
+		if fields[k] == nil {
+			fields[k] = make(map[string]float64)
+		}
+		if data, ok := row.Data.(*view.CountData); ok {
+			fields[k]["count"] = float64(data.Value)
+		}
+	}
+	for _, row := range latencyRows {
+		k := rowKey(row.Tags)
+		if fields[k] == nil {
+			fields[k] = make(map[string]float64)
+		}
+		if data, ok := row.Data.(*view.DistributionData); ok {
+			fields[k]["latency_ms"] = data.Mean
+		}
+	}
+
+	points := make([]string, 0, len(fields))
+	for k, f := range fields {
+		fieldParts := make([]string, 0, len(f))
+		for name, value := range f {
+			fieldParts = append(fieldParts, fmt.Sprintf("%s=%v", name, value))
+		}
+		points = append(points, fmt.Sprintf("nakama_api,function=%s,code=%s,node=%s %s",
+			escapeTagValue(k.function), escapeTagValue(k.code), escapeTagValue(e.config.NodeId), strings.Join(fieldParts, ",")))
+	}
+	return points
+}
+
+// influxRowKey groups a view row's count and latency fields together before
+// they're rendered into a single line protocol point.
+type influxRowKey struct {
+	function string
+	code     string
+}
+
+func rowKey(tags []tag.Tag) influxRowKey {
+	var k influxRowKey
+	for _, t := range tags {
+		switch t.Key {
+		case MetricsFunction:
+			k.function = t.Value
+		case MetricsGrpcCode:
+			k.code = t.Value
+		}
+	}
+	return k
+}
+
+func escapeTagValue(v string) string {
+	v = strings.ReplaceAll(v, " ", "\\ ")
+	v = strings.ReplaceAll(v, ",", "\\,")
+	v = strings.ReplaceAll(v, "=", "\\=")
+	return v
+}
+
+func (e *InfluxPushExporter) write(payload []byte) error {
+	body := payload
+	contentEncoding := ""
+	if e.config.Gzip {
+		var gzBuf bytes.Buffer
+		gz := gzip.NewWriter(&gzBuf)
+		if _, err := gz.Write(payload); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		body = gzBuf.Bytes()
+		contentEncoding = "gzip"
+	}
+
+	url := fmt.Sprintf("%s/write?db=%s", e.config.Address, e.config.Database)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("influx write failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nats-io/nats.go"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// MetricsNatsEventsDropped counts after-hook events dropped because the
+// publisher's buffered channel was full, i.e. NATS (or the network to it)
+// could not keep up with the request rate.
+var MetricsNatsEventsDropped = stats.Int64("nakama/nats_events_dropped", "Count of after-hook events dropped before reaching NATS", stats.UnitDimensionless)
+
+func init() {
+	view.Register(&view.View{
+		Name:        "nakama/nats_events_dropped",
+		Measure:     MetricsNatsEventsDropped,
+		Description: "Count of after-hook events dropped before reaching NATS",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{MetricsFunction},
+	})
+}
+
+// NatsPublisherConfig is loaded from the nats section of server.yml.
+type NatsPublisherConfig struct {
+	Enabled        bool
+	Address        string
+	SubjectPrefix  string
+	BufferSize     int
+	EnabledMethods map[string]bool
+}
+
+// natsAfterEvent is the structured payload published for every successful
+// API call, one subject per RPC name (e.g. "nakama.api.after.ListGroups").
+type natsAfterEvent struct {
+	UserId     string
+	Username   string
+	ClientIp   string
+	ClientPort string
+	Request    proto.Message
+	Response   proto.Message
+}
+
+// NatsPublisher fans a copy of every after-hook invocation out to NATS,
+// without blocking the request goroutine that produced it. A slow or
+// unreachable NATS cluster degrades to dropped events, never to stalled
+// API calls.
+type NatsPublisher struct {
+	logger *zap.Logger
+	config NatsPublisherConfig
+
+	conn   *nats.Conn
+	events chan natsPublishJob
+	stopCh chan struct{}
+}
+
+type natsPublishJob struct {
+	subject string
+	rpcName string
+	event   *natsAfterEvent
+}
+
+// NewNatsPublisher dials NATS with unlimited reconnect attempts and starts
+// the background drain loop. Reconnect attempts are spaced by a fixed 2
+// second ReconnectWait; the delay does not grow between attempts. It returns a nil-safe publisher (all
+// methods are no-ops) when config.Enabled is false, so call sites never need
+// a separate nil check beyond what Publish already does internally.
+func NewNatsPublisher(logger *zap.Logger, config NatsPublisherConfig) (*NatsPublisher, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 1024
+	}
+
+	p := &NatsPublisher{
+		logger: logger,
+		config: config,
+		events: make(chan natsPublishJob, bufferSize),
+		stopCh: make(chan struct{}),
+	}
+
+	conn, err := nats.Connect(config.Address,
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2*time.Second),
+		nats.ReconnectBufSize(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Warn("NATS disconnected", zap.Error(err))
+			}
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			logger.Info("NATS reconnected")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.conn = conn
+
+	go p.drain()
+	return p, nil
+}
+
+// Stop closes the NATS connection and stops the drain loop.
+func (p *NatsPublisher) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stopCh)
+	p.conn.Close()
+}
+
+// Publish queues an after-hook event for rpcName. It is safe to call on a
+// nil *NatsPublisher (the opt-in default) and returns immediately either
+// way - the buffered channel send never blocks the caller.
+func (p *NatsPublisher) Publish(rpcName, userID, username, clientIP, clientPort string, request, response proto.Message) {
+	if p == nil {
+		return
+	}
+	if enabled, ok := p.config.EnabledMethods[rpcName]; ok && !enabled {
+		return
+	}
+
+	job := natsPublishJob{
+		subject: p.config.SubjectPrefix + "." + rpcName,
+		rpcName: rpcName,
+		event: &natsAfterEvent{
+			UserId:     userID,
+			Username:   username,
+			ClientIp:   clientIP,
+			ClientPort: clientPort,
+			Request:    request,
+			Response:   response,
+		},
+	}
+
+	select {
+	case p.events <- job:
+		return
+	default:
+	}
+
+	// Buffer is full: drop the oldest queued event to make room rather than
+	// block the request goroutine, and record that a drop occurred.
+	select {
+	case <-p.events:
+	default:
+	}
+	select {
+	case p.events <- job:
+	default:
+	}
+	statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, rpcName))
+	stats.Record(statsCtx, MetricsNatsEventsDropped.M(1))
+}
+
+func (p *NatsPublisher) drain() {
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case job := <-p.events:
+			p.publish(job)
+		}
+	}
+}
+
+func (p *NatsPublisher) publish(job natsPublishJob) {
+	reqBytes, err := marshalNatsPayload(job.event.Request)
+	if err != nil {
+		p.logger.Warn("Error marshalling nats request payload", zap.Error(err))
+		return
+	}
+	respBytes, err := marshalNatsPayload(job.event.Response)
+	if err != nil {
+		p.logger.Warn("Error marshalling nats response payload", zap.Error(err))
+		return
+	}
+
+	payload := marshalNatsEnvelope(job.event, reqBytes, respBytes)
+	if err := p.conn.Publish(job.subject, payload); err != nil {
+		p.logger.Warn("Error publishing nats event", zap.Error(err), zap.String("subject", job.subject))
+	}
+}
+
+func marshalNatsPayload(msg proto.Message) ([]byte, error) {
+	if msg == nil {
+		return nil, nil
+	}
+	return proto.Marshal(msg)
+}
+
+// marshalNatsEnvelope frames event's identity/network fields and the
+// already-marshalled request/response payloads as a sequence of
+// length-prefixed segments (uint32 big-endian length + bytes, in declaration
+// order: user id, username, client ip, client port, request, response). A
+// subscriber can split the message back into its fields by reading the
+// prefixes in the same order, which a bare concatenation of reqBytes and
+// respBytes could never support.
+func marshalNatsEnvelope(event *natsAfterEvent, reqBytes, respBytes []byte) []byte {
+	segments := [][]byte{
+		[]byte(event.UserId),
+		[]byte(event.Username),
+		[]byte(event.ClientIp),
+		[]byte(event.ClientPort),
+		reqBytes,
+		respBytes,
+	}
+
+	size := 0
+	for _, s := range segments {
+		size += 4 + len(s)
+	}
+
+	payload := make([]byte, 0, size)
+	lenBytes := make([]byte, 4)
+	for _, s := range segments {
+		binary.BigEndian.PutUint32(lenBytes, uint32(len(s)))
+		payload = append(payload, lenBytes...)
+		payload = append(payload, s...)
+	}
+	return payload
+}
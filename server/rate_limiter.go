@@ -0,0 +1,258 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// MetricsApiRateLimited counts requests rejected by RateLimiter, tagged by
+// the RPC name that was throttled.
+var MetricsApiRateLimited = stats.Int64("nakama/api_rate_limited", "Count of API calls rejected by the rate limiter", stats.UnitDimensionless)
+
+// RateLimitRule is the configured token bucket shape for one RPC name.
+type RateLimitRule struct {
+	RatePerSecond float64
+	Burst         int
+}
+
+// RateLimiterConfig is loaded from the rate_limit section of server.yml.
+// Rules not present here are unlimited.
+type RateLimiterConfig struct {
+	Rules            map[string]RateLimitRule
+	ClusteringEnabled bool
+}
+
+// ClusterRateCounter replicates token-bucket consumption across nodes when
+// clustering is enabled, through whatever cluster transport the deployment
+// already uses. A single-node deployment never constructs one, so RateLimiter
+// falls back to the purely in-process buckets below.
+type ClusterRateCounter interface {
+	// Take reports whether one token for (rpcName, key) was available
+	// cluster-wide, consuming it if so.
+	Take(rpcName, key string, rule RateLimitRule) (bool, error)
+}
+
+// tokenBucket is a classic token bucket: it tracks a fractional token count
+// and the last time it was topped up, refilling lazily on each take call
+// instead of on a ticker so idle buckets cost nothing.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	lastFill time.Time
+	lastUsed time.Time
+	rule     RateLimitRule
+}
+
+func newTokenBucket(rule RateLimitRule) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{
+		tokens:   float64(rule.Burst),
+		lastFill: now,
+		lastUsed: now,
+		rule:     rule,
+	}
+}
+
+// take attempts to consume one token, returning the duration the caller
+// should wait before retrying if it could not.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.lastUsed = now
+	elapsed := now.Sub(b.lastFill).Seconds()
+	b.lastFill = now
+	b.tokens += elapsed * b.rule.RatePerSecond
+	if max := float64(b.rule.Burst); b.tokens > max {
+		b.tokens = max
+	}
+
+	if b.tokens < 1 {
+		missing := 1 - b.tokens
+		return false, time.Duration(missing/b.rule.RatePerSecond*1000) * time.Millisecond
+	}
+	b.tokens--
+	return true, 0
+}
+
+// idleSince reports how long it has been since this bucket last served a
+// take() call, for the sweep's eviction decision.
+func (b *tokenBucket) idleSince(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.lastUsed)
+}
+
+// rateLimiterShardCount keeps lock contention across unrelated users/IPs
+// low without a bucket-per-request allocation scheme.
+const rateLimiterShardCount = 32
+
+// rateLimiterIdleTTL is how long a bucket may go unused before the periodic
+// sweep reclaims it. It is set well above any realistic refill window so a
+// bucket is only ever reclaimed once it is genuinely cold, never while a
+// user or IP is still being actively throttled.
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// rateLimiterSweepInterval controls how often each shard is scanned for
+// idle buckets.
+const rateLimiterSweepInterval = time.Minute
+
+type rateLimiterShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// RateLimiter enforces a per-RPC token bucket keyed by both user ID and
+// client IP, so a single misbehaving user and a single misbehaving IP are
+// both contained independently of each other. It is applied before the
+// before-hook runs, ahead of any Lua/Go hook cost.
+type RateLimiter struct {
+	logger  *zap.Logger
+	config  RateLimiterConfig
+	cluster ClusterRateCounter
+
+	shards [rateLimiterShardCount]*rateLimiterShard
+	stopCh chan struct{}
+}
+
+// NewRateLimiter builds a limiter from config. Pass a non-nil cluster when
+// config.ClusteringEnabled so token consumption is replicated node-wide;
+// a nil cluster with ClusteringEnabled set behaves as single-node. Call
+// Start to begin reclaiming idle buckets.
+func NewRateLimiter(logger *zap.Logger, config RateLimiterConfig, cluster ClusterRateCounter) *RateLimiter {
+	l := &RateLimiter{
+		logger:  logger,
+		config:  config,
+		cluster: cluster,
+		stopCh:  make(chan struct{}),
+	}
+	for i := range l.shards {
+		l.shards[i] = &rateLimiterShard{buckets: make(map[string]*tokenBucket)}
+	}
+	return l
+}
+
+// Start launches the periodic sweep that reclaims buckets idle longer than
+// rateLimiterIdleTTL, bounding the memory a stream of distinct attacker-
+// controlled user ids/IPs could otherwise grow unboundedly. It should be
+// called once from ApiServer's constructor, mirroring GroupReaper.Start and
+// WasmRuntime.Start.
+func (l *RateLimiter) Start() {
+	go func() {
+		ticker := time.NewTicker(rateLimiterSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stopCh:
+				return
+			case <-ticker.C:
+				l.sweep()
+			}
+		}
+	}()
+}
+
+// Stop cancels the periodic sweep.
+func (l *RateLimiter) Stop() {
+	close(l.stopCh)
+}
+
+// sweep removes every bucket across all shards that has sat idle longer
+// than rateLimiterIdleTTL.
+func (l *RateLimiter) sweep() {
+	now := time.Now()
+	for _, shard := range l.shards {
+		shard.mu.Lock()
+		for key, bucket := range shard.buckets {
+			if bucket.idleSince(now) > rateLimiterIdleTTL {
+				delete(shard.buckets, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// Allow reports whether rpcName may proceed for the given user and client
+// IP. On rejection it returns the duration the caller should advertise via
+// Retry-After and records MetricsApiRateLimited.
+func (l *RateLimiter) Allow(rpcName, userID, clientIP string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	rule, ok := l.config.Rules[rpcName]
+	if !ok {
+		return true, 0
+	}
+
+	if l.config.ClusteringEnabled && l.cluster != nil {
+		ok, err := l.cluster.Take(rpcName, userID+"|"+clientIP, rule)
+		if err != nil {
+			l.logger.Warn("Error replicating rate limit counter, falling back to local bucket", zap.Error(err))
+		} else {
+			if !ok {
+				l.recordRateLimited(rpcName)
+			}
+			return ok, time.Second
+		}
+	}
+
+	if allowed, retryAfter := l.take(rpcName, "user:"+userID, rule); !allowed {
+		l.recordRateLimited(rpcName)
+		return false, retryAfter
+	}
+	if allowed, retryAfter := l.take(rpcName, "ip:"+clientIP, rule); !allowed {
+		l.recordRateLimited(rpcName)
+		return false, retryAfter
+	}
+	return true, 0
+}
+
+func (l *RateLimiter) take(rpcName, key string, rule RateLimitRule) (bool, time.Duration) {
+	shard := l.shards[shardIndex(rpcName+key, rateLimiterShardCount)]
+
+	shard.mu.Lock()
+	bucket, ok := shard.buckets[rpcName+key]
+	if !ok {
+		bucket = newTokenBucket(rule)
+		shard.buckets[rpcName+key] = bucket
+	}
+	shard.mu.Unlock()
+
+	return bucket.take()
+}
+
+func (l *RateLimiter) recordRateLimited(rpcName string) {
+	statsCtx, _ := tag.New(context.Background(), tag.Upsert(MetricsFunction, rpcName))
+	stats.Record(statsCtx, MetricsApiRateLimited.M(1))
+}
+
+// shardIndex hashes key into [0, shardCount) with FNV-1a, kept local to
+// avoid pulling in hash/fnv for a single call site.
+func shardIndex(key string, shardCount int) int {
+	var h uint32 = 2166136261
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h) % shardCount
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 The Nakama Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "testing"
+
+// These cover only the pure, wasmer-free pieces of the Wasm runtime. A real
+// beforeListGroups/afterListUserGroups hook round trip needs a compiled
+// .wasm fixture plus the wasmer-go CGO runtime, neither of which is
+// available in this environment - see InvokeBeforeHookProto/
+// InvokeAfterHookProto for that integration point. This is a known,
+// intentionally open gap in this package's test coverage, not an oversight:
+// flagging it here rather than claiming the hook round trip is exercised.
+
+func TestUnpackWasmResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		packed     int64
+		wantPtr    int32
+		wantLength int32
+	}{
+		{name: "zero", packed: 0, wantPtr: 0, wantLength: 0},
+		{name: "ptr and length", packed: int64(1024)<<32 | int64(256), wantPtr: 1024, wantLength: 256},
+		{name: "length only", packed: int64(42), wantPtr: 0, wantLength: 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ptr, length := unpackWasmResult(tt.packed)
+			if ptr != tt.wantPtr || length != tt.wantLength {
+				t.Fatalf("unpackWasmResult(%d) = (%d, %d), want (%d, %d)", tt.packed, ptr, length, tt.wantPtr, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestWasmHostEnvReadGuestStringNilInstance(t *testing.T) {
+	env := newWasmHostEnv(nil, nil)
+	if got := env.readGuestString(nil, 0, 10); got != "" {
+		t.Fatalf("readGuestString with nil instance = %q, want empty", got)
+	}
+	if got := env.readGuestString(nil, 0, 0); got != "" {
+		t.Fatalf("readGuestString with zero length = %q, want empty", got)
+	}
+}